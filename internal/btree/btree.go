@@ -3,114 +3,235 @@ package btree
 import (
 	c "mooodb/internal"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"mooodb/internal/btree/page"
 	"mooodb/internal/pager"
 )
 
 var (
 	BtreeErrorFrame = fmt.Errorf("Btree: Couldn't get frame")
-	BtreeErrorTemp = fmt.Errorf("Btree: temp-error")
-	CursorErrorTemp = fmt.Errorf("Cursor: temp-error")
+	BtreeErrorKeySize = fmt.Errorf("Btree: key larger than MAX_KEY_SIZE")
+	BtreeErrorValSize = fmt.Errorf("Btree: value larger than MAX_VAL_SIZE")
+	BtreeErrorCorrupt = fmt.Errorf("Btree: corrupt page")
+	BtreeErrorMagic = fmt.Errorf("Btree: not a MOOODB meta page")
+	BtreeErrorVersion = fmt.Errorf("Btree: unsupported version")
+	TxnErrorDone = fmt.Errorf("Txn: already committed or rolled back")
+	TxnErrorReadOnly = fmt.Errorf("Txn: read-only transaction")
+	TxnErrorBusy = fmt.Errorf("Txn: another write transaction is open")
 )
 
+// Keys and values are capped at an eighth of a page each, so an entry (with its slot) is at
+// most a little over a quarter of what a page holds - 1030 of 4032 bytes with 4K pages.
+// Splitting a full page by bytes, new entry included, leaves each half with at most half the
+// bytes plus one entry (under 3600), so both always have room to spare.
+const MAX_KEY_SIZE = c.PAGE_SIZE / 8
+const MAX_VAL_SIZE = c.PAGE_SIZE / 8
 
-// TODO: we need a lock to change anything on the meta page, such as root pointer
+// The meta pages always live at ids 0 and 1, it's how we find everything else when
+// reopening. Commits alternate between them, so if a meta page write gets torn the other one
+// still holds the previous commit.
+const META_PAGE_CNT = 2
+
+// Roots point back at the (first) meta page
+const ROOT_PARENT = 0
+
+
+// There is only ever one writer - write transactions hold writeMu from BeginWrite until they
+// commit or roll back, and everything below that isn't atomic belongs to whoever holds it.
+// Readers never take it, they start from whatever commit is in current.
 type Btree struct {
-	metaFrame 	*pager.Frame
-	metaPage 	*page.PageMeta
+	metaFrames 	[META_PAGE_CNT]*pager.Frame
+	metaPages 	[META_PAGE_CNT]page.PageMeta
+	metaCur 	int // which meta page holds the latest commit
 
 	pager 		*pager.Pager
 	gen	uint64 // generation
+
+	freeList 	[]uint64 // pages the persisted free-list of the latest commit lives on
+	pending 	[]retiredPages // oldest first
+
+	writeMu 	sync.Mutex
+	current 	atomic.Pointer[snapshot] // latest commit
+	snapshots 	[]*snapshot // commits readers might still be on, including current
+
+	scratch		[]byte // 2 pages, for defragmenting/splitting/merging - only touched by the writer
 }
 
-// TODO we cant reopen these, we have no "manifest"
+// Initializes a new, empty tree. The pager should be fresh (see pager.CreatePager).
 func CreateBtree(pager *pager.Pager) (*Btree, error) {
-	metaFrame := pager.CreatePage()
-	if metaFrame == nil {
-		return nil, BtreeErrorFrame
+	btree := Btree {
+		pager: 		pager,
+		gen: 		1,
+		scratch: 	make([]byte, 2 * c.PAGE_SIZE),
+	}
+
+	for i := range META_PAGE_CNT {
+		btree.metaFrames[i] = pager.CreatePageAt(uint64(i))
+		if btree.metaFrames[i] == nil {
+			btree.Close()
+			return nil, BtreeErrorFrame
+		}
 	}
 
 	rootFrame := pager.CreatePage()
 	if rootFrame == nil {
+		btree.Close()
 		return nil, BtreeErrorFrame
 	}
+	defer rootFrame.Release()
 
-	gen := uint64(1)
-
-	metaPage := page.PageMetaNew(metaFrame.BufferHandle(), metaFrame.PageId(), 
-		rootFrame.PageId(), gen)
 	rootPage := page.PageSlottedNew(rootFrame.BufferHandle(), rootFrame.PageId(),
-		true, gen, metaFrame.PageId())
-
-	metaPage.DoChecksum()
-	metaPage.SetPageCnt(1)
+		true, btree.gen, ROOT_PARENT)
 	rootPage.DoChecksum()
 
-	pager.WritePage(metaFrame)
-	pager.WritePage(rootFrame)
-
-	rootFrame.Release()
+	// both meta pages point at the empty root, the second one with an older generation so
+	// the first commit goes there
+	for i := range META_PAGE_CNT {
+		frame := btree.metaFrames[i]
+		btree.metaPages[i] = page.PageMetaNew(frame.BufferHandle(), frame.PageId(),
+			rootFrame.PageId(), btree.gen - uint64(i))
+		btree.metaPages[i].SetPageCnt(pager.NextId())
+		btree.metaPages[i].DoChecksum()
+	}
 
-	btree := Btree {
-		metaFrame: 	metaFrame,
-		metaPage: 	&metaPage,
-		pager: 		pager,
-		gen: 		gen,
+	// root first, so a meta page never points at something that isn't there
+	err := pager.WritePage(rootFrame)
+	for i := range META_PAGE_CNT {
+		if err == nil { err = pager.Sync() }
+		if err == nil { err = pager.WritePage(btree.metaFrames[i]) }
 	}
+	if err == nil { err = pager.Sync() }
+	if err != nil {
+		btree.Close()
+		return nil, err
+	}
+	btree.publishSnapshot()
 
 	return &btree, nil
 }
 
-const CURSOR_STACK_DEPTH = 64
-type CursorCrumb struct {
-	pageId 	uint64
-	slot	uint16
-	_		[6]byte
-}
+// Reopens an existing tree from whichever meta page holds the latest valid commit. The
+// pager should have been opened on an existing file (see pager.OpenPager).
+func OpenBtree(pager *pager.Pager) (*Btree, error) {
+	btree := Btree {
+		pager: 		pager,
+		metaCur: 	-1,
+		scratch: 	make([]byte, 2 * c.PAGE_SIZE),
+	}
 
-type Cursor struct {
-	btree		*Btree
-	stack	[CURSOR_STACK_DEPTH]CursorCrumb
-	stackPtr	int
-}
+	var firstErr error
+	for i := range META_PAGE_CNT {
+		frame := pager.GetPage(uint64(i))
+		if frame == nil {
+			btree.Close()
+			return nil, BtreeErrorFrame
+		}
+		btree.metaFrames[i] = frame
+		btree.metaPages[i] = page.PageMetaFrom(frame.BufferHandle())
+
+		err := frame.Wait()
+		if err == nil { err = validateMeta(&btree.metaPages[i]) }
+		if err != nil {
+			if firstErr == nil { firstErr = err }
+			continue
+		}
+
+		if btree.metaCur < 0 || btree.metaPages[i].Gen() > btree.gen {
+			btree.metaCur = i
+			btree.gen = btree.metaPages[i].Gen()
+		}
+	}
 
-func CreateCursor(btree *Btree) *Cursor {
-	return &Cursor{
-		btree: btree,
+	if btree.metaCur < 0 {
+		btree.Close()
+		return nil, firstErr
 	}
-}
 
-// returns whether exact key was found or not
-func (crs *Cursor) Seek(key []byte) (bool, error) {
-	crs.stackPtr = 0
+	// anything past PageCnt was never committed, so it's fair game to overwrite
+	pager.SetNextId(btree.meta().PageCnt())
 
-	frame := crs.btree.pager.GetPage(crs.btree.metaPage.RootId())
-	if frame == nil { return false, CursorErrorTemp }
-	curPage := page.PageSlottedFrom(frame.BufferHandle())
+	if err := btree.readFreeList(); err != nil {
+		btree.Close()
+		return nil, err
+	}
+	btree.publishSnapshot()
 
-	crs.stack[crs.stackPtr].pageId = curPage.Id()
+	return &btree, nil
+}
 
-	for curPage.IsTypeInner() {
-		pageIdVal, slot := curPage.GetSmallestGreater(key)
-		if slot < 0 { return false, nil }
+func validateMeta(metaPage *page.PageMeta) error {
+	if !metaPage.IsTypeMeta() || !metaPage.MagicOk() {
+		return BtreeErrorMagic
+	}
+	if metaPage.Ver() != page.Version {
+		return BtreeErrorVersion
+	}
+	return nil
+}
 
-		crs.stack[crs.stackPtr].slot = uint16(slot)
-		crs.stackPtr += 1
+// Unpins the meta pages. The pager is left open, it belongs to the caller.
+func (bt *Btree) Close() {
+	for i, frame := range bt.metaFrames {
+		if frame != nil {
+			frame.Release()
+			bt.metaFrames[i] = nil
+		}
+	}
+}
 
-		pageId := c.Bin.Uint64(pageIdVal)
+// Meta page of the latest commit
+func (bt *Btree) meta() *page.PageMeta {
+	return &bt.metaPages[bt.metaCur]
+}
 
-		frame = crs.btree.pager.GetPage(pageId)
-		if frame == nil { return false, CursorErrorTemp }
-		curPage = page.PageSlottedFrom(frame.BufferHandle())
-	}
+// Point lookup against the latest commit. The value is copied out of the page so callers
+// never hold onto pager memory.
+func (bt *Btree) Get(key []byte) ([]byte, bool, error) {
+	txn := bt.BeginRead()
+	defer txn.Rollback()
+	return txn.Get(key)
+}
 
-	// now we're at a leaf page
+// Inserts (or overwrites) key in a transaction of its own.
+func (bt *Btree) Insert(key []byte, val []byte) error {
+	txn := bt.BeginWrite()
+	defer txn.Rollback()
 
-	slot := curPage.Seek(key)
-	if slot < 0 { return false, nil }
-	crs.stack[crs.stackPtr].slot = uint16(slot)
+	if err := txn.Insert(key, val); err != nil { return err }
+	return txn.Commit()
+}
 
-	return true, nil
+// Commits a new root by writing it to the older of the two meta pages. Everything the new
+// root points at has to be synced already (see commit), so it's on disk before the meta page
+// that points at it - the sync here makes the commit itself durable. If we crash in between,
+// the other meta page still holds the previous commit.
+func (bt *Btree) publish(rootId uint64, gen uint64, freeList uint64) error {
+	// the whole header is rewritten - the slot might not have held a valid meta page at all
+	// (ie. we crashed in CreateBtree before getting to it)
+	next := (bt.metaCur + 1) % META_PAGE_CNT
+	frame := bt.metaFrames[next]
+	bt.metaPages[next] = page.PageMetaNew(frame.BufferHandle(), uint64(next), rootId, gen)
+	meta := &bt.metaPages[next]
+	meta.SetFreeList(freeList)
+	meta.SetPageCnt(bt.pager.NextId())
+	meta.DoChecksum()
+
+	if err := bt.pager.WritePage(bt.metaFrames[next]); err != nil { return err }
+	if err := bt.pager.Sync(); err != nil { return err }
+
+	bt.metaCur = next
+	bt.gen = gen
+	bt.publishSnapshot()
+	return nil
 }
 
+// Deletes key in a transaction of its own, returns whether it existed.
+func (bt *Btree) Delete(key []byte) (bool, error) {
+	txn := bt.BeginWrite()
+	defer txn.Rollback()
 
+	found, err := txn.Delete(key)
+	if err != nil || !found { return false, err }
+	return true, txn.Commit()
+}
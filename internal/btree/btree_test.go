@@ -1,48 +1,571 @@
 package btree
 
 import (
-	"math/rand/v2"
+	c "mooodb/internal"
+	"mooodb/internal/btree/page"
 	"mooodb/internal/pager"
+	"mooodb/internal/system"
+
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"path/filepath"
 	"testing"
 
 	"github.com/brianvoe/gofakeit/v7"
+	"github.com/stretchr/testify/assert"
 )
 
+func tempfile(t *testing.T) string {
+	dir := t.TempDir()
+	return filepath.Join(dir, fmt.Sprintf("moootest%016x.moo", rand.Uint64()))
+}
+
+// Everything but Test_Btree_Reopen runs in memory, there's no need to wait on a disk
+var memfs = system.NewMemFS()
+
+func memfile() string {
+	return fmt.Sprintf("moootest%016x.moo", rand.Uint64())
+}
+
+func createTestBtree(t *testing.T, pageCnt int) *Btree {
+	pager, err := pager.CreatePagerWith(memfs.Open, memfile(), pageCnt)
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() { pager.Close() })
+
+	btree, err := CreateBtree(pager)
+	if err != nil { t.Fatal(err) }
+	return btree
+}
+
+// Walks the whole tree straight off the pager, checking that keys are ordered and inside
+// the bounds their parents route by, and that nothing is newer than the tree itself.
+// Returns every pair in key order.
+func dumpTree(t *testing.T, bt *Btree) ([][2]string, int) {
+	var pairs [][2]string
+	depth := -1
+
+	var walk func(pageId uint64, low []byte, high []byte, level int)
+	walk = func(pageId uint64, low []byte, high []byte, level int) {
+		frame := bt.pager.GetPage(pageId)
+		if frame == nil { t.Fatal("no frame") }
+		defer frame.Release()
+		if err := frame.Wait(); err != nil { t.Fatal(err) }
+
+		pg := page.PageSlottedFrom(frame.BufferHandle())
+		assert.Equal(t, pageId, pg.Id())
+		assert.LessOrEqual(t, pg.Gen(), bt.gen)
+
+		n := pg.EntryCount()
+		for i := range n {
+			k := pg.KeyAt(i)
+			if i > 0 { assert.Less(t, string(pg.KeyAt(i-1)), string(k)) }
+			if pg.IsTypeInner() && i == 0 { continue } // only a lower bound
+			assert.True(t, bytes.Compare(k, low) >= 0, "key below bound")
+			if high != nil { assert.True(t, bytes.Compare(k, high) < 0, "key above bound") }
+		}
+
+		if pg.IsTypeLeaf() {
+			if depth < 0 { depth = level }
+			assert.Equal(t, depth, level, "leaves at different depths")
+			for i := range n {
+				pairs = append(pairs, [2]string{string(pg.KeyAt(i)), string(pg.ValAt(i))})
+			}
+			return
+		}
+
+		assert.Greater(t, n, uint16(0))
+		for i := range n {
+			childLow := bytes.Clone(pg.KeyAt(i))
+			if i == 0 { childLow = low }
+			childHigh := high
+			if i+1 < n { childHigh = bytes.Clone(pg.KeyAt(i + 1)) }
+			walk(c.Bin.Uint64(pg.ValAt(i)), childLow, childHigh, level+1)
+		}
+	}
+
+	walk(bt.meta().RootId(), []byte{}, nil, 0)
+	return pairs, depth
+}
+
 func Test_Btree(t *testing.T) {
 	seed := [32]byte{0}
 	r := rand.NewChaCha8(seed)
 	gofakeit.NewFaker(r, true) // faker :=
 
-	pager, err := pager.CreatePager("/xblk/test/wew.moo", 32)
+	pager, err := pager.CreatePagerWith(memfs.Open, memfile(), 32)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
 	_, err = CreateBtree(pager) // btree, err :=
 	if err != nil { t.Fatal(err) }
 }
 
-/*
-func Test_Btree(t *testing.T) {
+func Test_Btree_Insert(t *testing.T) {
 	seed := [32]byte{0}
-	r := rand.NewChaCha8(seed)
-	faker := gofakeit.NewFaker(r, true)
+	faker := gofakeit.NewFaker(rand.NewChaCha8(seed), true)
+
+	btree := createTestBtree(t, 32)
+
+	expected := make(map[string]string)
+	for range 2000 {
+		key := faker.DomainName()
+		val := faker.ProductUPC()
+		expected[key] = val
+		if err := btree.Insert([]byte(key), []byte(val)); err != nil { t.Fatal(err) }
+	}
+
+	// overwrite a third of them
+	overwritten := 0
+	for key := range expected {
+		if overwritten == len(expected) / 3 { break }
+		val := faker.Word()
+		expected[key] = val
+		if err := btree.Insert([]byte(key), []byte(val)); err != nil { t.Fatal(err) }
+		overwritten++
+	}
+
+	pairs, depth := dumpTree(t, btree)
+	assert.Greater(t, depth, 0, "root should have split")
+	assert.Equal(t, len(expected), len(pairs))
+	for _, pair := range pairs {
+		assert.Equal(t, expected[pair[0]], pair[1])
+	}
+}
+
+func Test_Btree_Insert_CoW(t *testing.T) {
+	btree := createTestBtree(t, 32)
+
+	for i := range 300 {
+		key := fmt.Appendf(nil, "key%05d", i)
+		if err := btree.Insert(key, bytes.Repeat([]byte{'v'}, 64)); err != nil { t.Fatal(err) }
+	}
+
+	oldRoot := btree.meta().RootId()
+	oldGen := btree.gen
+
+	if err := btree.Insert([]byte("key00150"), []byte("new")); err != nil { t.Fatal(err) }
+
+	assert.NotEqual(t, oldRoot, btree.meta().RootId(), "root should have been copied")
+	assert.Equal(t, oldGen+1, btree.gen)
+	assert.Equal(t, btree.gen, btree.meta().Gen())
+
+	frame := btree.pager.GetPage(btree.meta().RootId())
+	if err := frame.Wait(); err != nil { t.Fatal(err) }
+	root := page.PageSlottedFrom(frame.BufferHandle())
+	assert.Equal(t, btree.gen, root.Gen())
+	frame.Release()
+
+	// the old root is untouched
+	frame = btree.pager.GetPage(oldRoot)
+	if err := frame.Wait(); err != nil { t.Fatal(err) }
+	root = page.PageSlottedFrom(frame.BufferHandle())
+	assert.Equal(t, oldGen, root.Gen())
+	frame.Release()
+}
+
+func Test_Btree_Insert_Too_Large(t *testing.T) {
+	btree := createTestBtree(t, 32)
+
+	assert.Equal(t, BtreeErrorKeySize, btree.Insert(make([]byte, MAX_KEY_SIZE+1), nil))
+	assert.Equal(t, BtreeErrorValSize, btree.Insert([]byte("k"), make([]byte, MAX_VAL_SIZE+1)))
+	assert.NoError(t, btree.Insert(make([]byte, MAX_KEY_SIZE), make([]byte, MAX_VAL_SIZE)))
+}
+
+func Test_Btree_Insert_Max_Sizes(t *testing.T) {
+	btree := createTestBtree(t, 32)
+
+	r := rand.New(rand.NewPCG(1, 2))
+	expected := make(map[string]string)
+	for range 500 {
+		key := make([]byte, 1 + r.IntN(MAX_KEY_SIZE))
+		for i := range key { key[i] = byte(r.Uint32()) }
+		val := make([]byte, r.IntN(MAX_VAL_SIZE+1))
+		expected[string(key)] = string(val)
+		if err := btree.Insert(key, val); err != nil { t.Fatal(err) }
+	}
+
+	pairs, depth := dumpTree(t, btree)
+	assert.Greater(t, depth, 1, "should have split inner pages too")
+	assert.Equal(t, len(expected), len(pairs))
+	for _, pair := range pairs {
+		assert.Equal(t, expected[pair[0]], pair[1])
+	}
+}
+
+func Test_Btree_Get(t *testing.T) {
+	seed := [32]byte{0}
+	faker := gofakeit.NewFaker(rand.NewChaCha8(seed), true)
+
+	// small pool - leaking pins would run us out of frames quickly
+	btree := createTestBtree(t, 16)
+
+	expected := make(map[string]string)
+	for range 1000 {
+		key := faker.DomainName()
+		val := faker.ProductUPC()
+		expected[key] = val
+		if err := btree.Insert([]byte(key), []byte(val)); err != nil { t.Fatal(err) }
+	}
+
+	for range 3 {
+		for key, val := range expected {
+			res, found, err := btree.Get([]byte(key))
+			if err != nil { t.Fatal(err) }
+			assert.True(t, found, key)
+			assert.Equal(t, val, string(res))
+		}
+	}
+
+	for range 100 {
+		key := faker.Username()
+		_, isExpected := expected[key]
+		_, found, err := btree.Get([]byte(key))
+		if err != nil { t.Fatal(err) }
+		assert.Equal(t, isExpected, found)
+	}
+}
+
+func Test_Btree_Get_Copies(t *testing.T) {
+	btree := createTestBtree(t, 16)
+
+	if err := btree.Insert([]byte("cow"), []byte("moo")); err != nil { t.Fatal(err) }
+
+	res, found, err := btree.Get([]byte("cow"))
+	if err != nil || !found { t.Fatal(found, err) }
+	res[0] = 'b'
+
+	res, _, _ = btree.Get([]byte("cow"))
+	assert.Equal(t, "moo", string(res))
+
+	_, found, err = btree.Get([]byte("bull"))
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func Test_Btree_Delete(t *testing.T) {
+	seed := [32]byte{0}
+	faker := gofakeit.NewFaker(rand.NewChaCha8(seed), true)
+
+	btree := createTestBtree(t, 32)
+
+	expected := make(map[string]string)
+	for range 3000 {
+		key := faker.DomainName()
+		val := faker.ProductUPC()
+		expected[key] = val
+		if err := btree.Insert([]byte(key), []byte(val)); err != nil { t.Fatal(err) }
+	}
+	_, depthBefore := dumpTree(t, btree)
+
+	// all but 50
+	for key := range expected {
+		if len(expected) == 50 { break }
+		existed, err := btree.Delete([]byte(key))
+		if err != nil { t.Fatal(err) }
+		assert.True(t, existed)
+		delete(expected, key)
+	}
+
+	existed, err := btree.Delete([]byte("not.a.domain"))
+	assert.NoError(t, err)
+	assert.False(t, existed)
+
+	pairs, depth := dumpTree(t, btree)
+	assert.Less(t, depth, depthBefore, "tree should have shrunk")
+	assert.Equal(t, len(expected), len(pairs))
+	for _, pair := range pairs {
+		assert.Equal(t, expected[pair[0]], pair[1])
+	}
+
+	for key, val := range expected {
+		res, found, err := btree.Get([]byte(key))
+		if err != nil { t.Fatal(err) }
+		assert.True(t, found)
+		assert.Equal(t, val, string(res))
+	}
+}
+
+func Test_Btree_Delete_All(t *testing.T) {
+	btree := createTestBtree(t, 32)
+
+	r := rand.New(rand.NewPCG(3, 4))
+	keys := make([][]byte, 0, 1500)
+	for i := range 1500 {
+		key := fmt.Appendf(nil, "%08d", i)
+		keys = append(keys, key)
+		val := make([]byte, r.IntN(MAX_VAL_SIZE/2))
+		if err := btree.Insert(key, val); err != nil { t.Fatal(err) }
+	}
+	r.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	for i, key := range keys {
+		existed, err := btree.Delete(key)
+		if err != nil { t.Fatal(err) }
+		assert.True(t, existed)
+
+		if i % 100 == 0 {
+			pairs, _ := dumpTree(t, btree)
+			assert.Equal(t, len(keys) - i - 1, len(pairs))
+		}
+	}
+
+	pairs, depth := dumpTree(t, btree)
+	assert.Equal(t, 0, len(pairs))
+	assert.Equal(t, 0, depth, "should have collapsed back to a single leaf")
+}
+
+func Test_Btree_Delete_Merges(t *testing.T) {
+	btree := createTestBtree(t, 32)
+
+	for i := range 2000 {
+		key := fmt.Appendf(nil, "%08d", i)
+		if err := btree.Insert(key, bytes.Repeat([]byte{'v'}, 32)); err != nil { t.Fatal(err) }
+	}
+	leavesBefore := countLeaves(t, btree)
+
+	// delete 9 of every 10 keys, what's left should get packed into far fewer pages
+	for i := range 2000 {
+		if i % 10 == 0 { continue }
+		key := fmt.Appendf(nil, "%08d", i)
+		if _, err := btree.Delete(key); err != nil { t.Fatal(err) }
+	}
+
+	leavesAfter := countLeaves(t, btree)
+	assert.Less(t, leavesAfter, leavesBefore / 4)
+}
+
+func countLeaves(t *testing.T, bt *Btree) int {
+	cnt := 0
+	var walk func(pageId uint64)
+	walk = func(pageId uint64) {
+		frame := bt.pager.GetPage(pageId)
+		if err := frame.Wait(); err != nil { t.Fatal(err) }
+		pg := page.PageSlottedFrom(frame.BufferHandle())
+		var children []uint64
+		if pg.IsTypeLeaf() {
+			cnt++
+		} else {
+			for i := range pg.EntryCount() {
+				children = append(children, c.Bin.Uint64(pg.ValAt(i)))
+			}
+		}
+		frame.Release()
+		for _, child := range children {
+			walk(child)
+		}
+	}
+	walk(bt.meta().RootId())
+	return cnt
+}
+
+func Test_Btree_Reopen(t *testing.T) {
+	seed := [32]byte{0}
+	faker := gofakeit.NewFaker(rand.NewChaCha8(seed), true)
+	fp := tempfile(t)
 
-	pager, err := pager.CreatePager("/xblk/test/wew.moo", 32)
+	pgr, err := pager.CreatePager(fp, 32)
+	if err != nil { t.Fatal(err) }
+	btree, err := CreateBtree(pgr)
 	if err != nil { t.Fatal(err) }
 
-	btree, err := CreateBtree(pager)
+	expected := make(map[string]string)
+	insert := func(n int) {
+		for range n {
+			key := faker.DomainName()
+			val := faker.ProductUPC()
+			expected[key] = val
+			if err := btree.Insert([]byte(key), []byte(val)); err != nil { t.Fatal(err) }
+		}
+	}
+	reopen := func() {
+		rootId, gen, nextId := btree.meta().RootId(), btree.gen, pgr.NextId()
+		btree.Close()
+		pgr.Close()
+
+		pgr, err = pager.OpenPager(fp, 32)
+		if err != nil { t.Fatal(err) }
+		btree, err = OpenBtree(pgr)
+		if err != nil { t.Fatal(err) }
+
+		assert.Equal(t, rootId, btree.meta().RootId())
+		assert.Equal(t, gen, btree.gen)
+		assert.Equal(t, nextId, pgr.NextId())
+	}
+
+	insert(500)
+	reopen()
+
+	// new pages must not land on top of the old ones
+	insert(500)
+	reopen()
+
+	pairs, _ := dumpTree(t, btree)
+	assert.Equal(t, len(expected), len(pairs))
+	for _, pair := range pairs {
+		assert.Equal(t, expected[pair[0]], pair[1])
+	}
+
+	btree.Close()
+	pgr.Close()
+}
+
+func Test_Btree_Open_Invalid(t *testing.T) {
+	fp := memfile()
+
+	pgr, err := pager.CreatePagerWith(memfs.Open, fp, 8)
+	if err != nil { t.Fatal(err) }
+	btree, err := CreateBtree(pgr)
+	if err != nil { t.Fatal(err) }
+
+	// flip a bit on both without fixing up the checksums
+	for i := range META_PAGE_CNT {
+		btree.metaPages[i].SetPageCnt(btree.metaPages[i].PageCnt() + 1)
+		assert.NoError(t, pgr.WritePage(btree.metaFrames[i]))
+	}
+	btree.Close()
+	pgr.Close()
+
+	pgr, err = pager.OpenPagerWith(memfs.Open, fp, 8)
 	if err != nil { t.Fatal(err) }
+	_, err = OpenBtree(pgr)
+	var corrupt *pager.ErrPageCorrupt
+	assert.ErrorAs(t, err, &corrupt, "the pager catches these before validateMeta does")
+	pgr.Close()
 
-	var name []byte
-	for range 128 {
-		name = []byte(faker.DomainName())
-		btree.Insert(name, []byte( faker.ProductUPC() ))
+	// not a meta page at all
+	raw := make([]byte, c.PAGE_SIZE * 3)
+	for i := range 3 {
+		pg := page.PageFreeNew(raw[i*c.PAGE_SIZE:(i+1)*c.PAGE_SIZE], uint64(i), 1)
+		pg.DoChecksum()
 	}
+	memfs.WriteFile(fp, raw)
+	pgr, err = pager.OpenPagerWith(memfs.Open, fp, 8)
+	if err != nil { t.Fatal(err) }
+	_, err = OpenBtree(pgr)
+	assert.Equal(t, BtreeErrorMagic, err)
+	pgr.Close()
+}
+
+func Test_Btree_Corrupt_Page(t *testing.T) {
+	fp := memfile()
+
+	pgr, err := pager.CreatePagerWith(memfs.Open, fp, 16)
+	if err != nil { t.Fatal(err) }
+	btree, err := CreateBtree(pgr)
+	if err != nil { t.Fatal(err) }
+	if err := btree.Insert([]byte("key"), []byte("val")); err != nil { t.Fatal(err) }
+	rootId := btree.meta().RootId()
+	btree.Close()
+	pgr.Close()
+
+	file := memfs.File(fp)
+	_, err = file.WriteAt([]byte{0xee}, int64(c.PageIdToOffset(rootId)) + c.PAGE_SIZE - 1)
+	assert.NoError(t, err)
+
+	pgr, err = pager.OpenPagerWith(memfs.Open, fp, 16)
+	if err != nil { t.Fatal(err) }
+	defer pgr.Close()
+	btree, err = OpenBtree(pgr)
+	if err != nil { t.Fatal(err) }
+	defer btree.Close()
+
+	_, _, err = btree.Get([]byte("key"))
+	var corrupt *pager.ErrPageCorrupt
+	assert.ErrorAs(t, err, &corrupt)
+	assert.Equal(t, rootId, corrupt.PageId)
+}
+
+func Test_Btree_Open_Invalid_Meta_Slot(t *testing.T) {
+	fp := memfile()
+
+	pgr, err := pager.CreatePagerWith(memfs.Open, fp, 8)
+	if err != nil { t.Fatal(err) }
+	btree, err := CreateBtree(pgr)
+	if err != nil { t.Fatal(err) }
+	next := (btree.metaCur + 1) % META_PAGE_CNT
+	btree.Close()
+	pgr.Close()
+
+	// as if we crashed before the second meta page was written - the next commit goes there
+	memfs.File(fp).WriteAt(make([]byte, c.PAGE_SIZE), int64(next * c.PAGE_SIZE))
+
+	pgr, err = pager.OpenPagerWith(memfs.Open, fp, 8)
+	if err != nil { t.Fatal(err) }
+	btree, err = OpenBtree(pgr)
+	if err != nil { t.Fatal(err) }
+	if err := btree.Insert([]byte("a"), []byte("b")); err != nil { t.Fatal(err) }
+	assert.Equal(t, next, btree.metaCur)
+	btree.Close()
+	pgr.Close()
 
-	fmt.Println(btree.Get(name))
+	pgr, err = pager.OpenPagerWith(memfs.Open, fp, 8)
+	if err != nil { t.Fatal(err) }
+	defer pgr.Close()
+	btree, err = OpenBtree(pgr)
+	if err != nil { t.Fatal(err) }
+	defer btree.Close()
+
+	assert.Equal(t, next, btree.metaCur, "the commit landed in the slot that was invalid")
+	res, found, err := btree.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "b", string(res))
+	checkPageAccounting(t, btree)
+}
+
+func Test_Btree_Meta_Alternates(t *testing.T) {
+	btree := createTestBtree(t, 16)
+
+	for i := range 6 {
+		cur := btree.metaCur
+		if err := btree.Insert(fmt.Appendf(nil, "%d", i), nil); err != nil { t.Fatal(err) }
+
+		assert.NotEqual(t, cur, btree.metaCur)
+		assert.Equal(t, btree.gen, btree.meta().Gen())
+		assert.Equal(t, btree.gen - 1, btree.metaPages[cur].Gen(), "older meta keeps previous commit")
+		for i := range META_PAGE_CNT {
+			assert.NoError(t, validateMeta(&btree.metaPages[i]))
+		}
+	}
+}
+
+func Test_Btree_Open_Torn_Meta(t *testing.T) {
+	fp := memfile()
+
+	pgr, err := pager.CreatePagerWith(memfs.Open, fp, 16)
+	if err != nil { t.Fatal(err) }
+	btree, err := CreateBtree(pgr)
+	if err != nil { t.Fatal(err) }
+
+	for i := range 200 {
+		if err := btree.Insert(fmt.Appendf(nil, "%04d", i), []byte("before")); err != nil { t.Fatal(err) }
+	}
+	prevRoot, prevGen := btree.meta().RootId(), btree.gen
+
+	if err := btree.Insert([]byte("0000"), []byte("after")); err != nil { t.Fatal(err) }
+
+	// tear the latest meta page - half of it is left over from whatever was there before
+	latest := btree.metaFrames[btree.metaCur]
+	copy(latest.BufferHandle()[c.PAGE_SIZE/2:], bytes.Repeat([]byte{0xee}, c.PAGE_SIZE/2))
+	assert.NoError(t, pgr.WritePage(latest))
+	btree.Close()
+	pgr.Close()
+
+	pgr, err = pager.OpenPagerWith(memfs.Open, fp, 16)
+	if err != nil { t.Fatal(err) }
+	defer pgr.Close()
+	btree, err = OpenBtree(pgr)
+	if err != nil { t.Fatal(err) }
+	defer btree.Close()
 
-	//res, err := btree.Get([]byte("yooo"))
-	//if err != nil { t.Fatal(err) }
+	assert.Equal(t, prevRoot, btree.meta().RootId())
+	assert.Equal(t, prevGen, btree.gen)
 
-	btree.BigTesta()
+	res, found, err := btree.Get([]byte("0000"))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "before", string(res))
 
-	//assert.Equal(t, res, []byte("hahahaha!!"))
+	pairs, _ := dumpTree(t, btree)
+	assert.Equal(t, 200, len(pairs))
 }
-*/
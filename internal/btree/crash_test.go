@@ -0,0 +1,152 @@
+package btree
+
+import (
+	"mooodb/internal/pager"
+	"mooodb/internal/system"
+
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"testing"
+)
+
+// go test ./internal/btree -run Test_Crash_Torture -crash.seed=N to replay a failure
+var (
+	crashSeed = flag.Uint64("crash.seed", 0, "seed for Test_Crash_Torture, 0 picks one")
+	crashRuns = flag.Int("crash.runs", 4, "databases Test_Crash_Torture builds, one seed each")
+	crashRounds = flag.Int("crash.rounds", 24, "times Test_Crash_Torture crashes each database")
+)
+
+// Contents of the tree as of some commit
+type committed map[string][]byte
+
+func Test_Crash_Torture(t *testing.T) {
+	seed := *crashSeed
+	if seed == 0 { seed = rand.Uint64() }
+
+	for run := range *crashRuns {
+		runSeed := seed + uint64(run)
+		t.Run(fmt.Sprint(runSeed), func(t *testing.T) {
+			t.Logf("-crash.seed=%d -crash.runs=1", runSeed)
+			crashTorture(t, runSeed, *crashRounds)
+		})
+	}
+}
+
+// Builds a database, then over and over: reopens it on a backend that is going to crash at
+// some random write or sync, checks that it holds exactly what the last commit that
+// returned left in it (or the one that was in flight when the lights went out), and runs
+// random transactions until the crash.
+func crashTorture(t *testing.T, seed uint64, rounds int) {
+	r := rand.New(rand.NewPCG(seed, seed))
+	fs := system.NewMemFS()
+	const FP = "torture.moo"
+	const FRAMES = 32 // small, so eviction and write-back are in the mix
+
+	pgr, err := pager.CreatePagerWith(fs.Open, FP, FRAMES)
+	if err != nil { t.Fatal(err) }
+	btree, err := CreateBtree(pgr)
+	if err != nil { t.Fatal(err) }
+	btree.Close()
+	pgr.Close()
+
+	durable := committed{}
+	var inFlight committed // nil unless a commit died without returning
+
+	for round := range rounds {
+		var fb *system.FaultBackend
+		plan := system.FaultPlan{
+			Seed: 		r.Uint64(),
+			Fail: 		0.002,
+			CrashAt: 	1 + r.Uint64N(400),
+		}
+		open := system.FaultOpener(fs.Open, plan, func(opened *system.FaultBackend) { fb = opened })
+
+		pgr, err := pager.OpenPagerWith(open, FP, FRAMES)
+		if err != nil { t.Fatal(round, err) }
+		btree, err := OpenBtree(pgr)
+		if err != nil { t.Fatalf("round %d: reopening: %v", round, err) }
+
+		durable = checkRecovered(t, round, btree, durable, inFlight)
+		checkPageAccounting(t, btree)
+
+		durable, inFlight = crashWorkload(t, r, btree, durable, fb)
+
+		btree.Close()
+		pgr.Close()
+	}
+}
+
+// The tree has to hold exactly durable or exactly inFlight - nothing in between, and
+// nothing older. Returns whichever it was.
+func checkRecovered(t *testing.T, round int, btree *Btree, durable committed, inFlight committed) committed {
+	pairs, _ := dumpTree(t, btree)
+	got := committed{}
+	for _, pair := range pairs {
+		got[pair[0]] = []byte(pair[1])
+	}
+
+	if maps.EqualFunc(got, durable, sameVal) { return durable }
+	if inFlight != nil && maps.EqualFunc(got, inFlight, sameVal) { return inFlight }
+	t.Fatalf("round %d: recovered %d keys, last commit had %d (in flight: %d)",
+		round, len(got), len(durable), len(inFlight))
+	return nil
+}
+
+func sameVal(a []byte, b []byte) bool {
+	return string(a) == string(b)
+}
+
+// Random insert/delete transactions, most committed and some rolled back, until something
+// fails. That should only ever be the backend crashing, or failing an op on purpose - in the
+// second case we crash it ourselves. Returns the last commit that went through, and what a
+// commit that failed partway would have left (nil if there wasn't one).
+func crashWorkload(t *testing.T, r *rand.Rand, btree *Btree, durable committed, fb *system.FaultBackend) (committed, committed) {
+	checkErr := func(err error) {
+		if fb.Crashed() && !errors.Is(err, pager.ErrIOFailed) {
+			t.Fatal("error after the crash isn't ErrIOFailed:", err)
+		}
+	}
+
+	for !fb.Crashed() {
+		next := maps.Clone(durable)
+		txn := btree.BeginWrite()
+
+		var err error
+		for range 1 + r.IntN(12) {
+			key := fmt.Sprintf("key%05d", r.IntN(800))
+			if r.IntN(3) == 0 {
+				_, err = txn.Delete([]byte(key))
+				delete(next, key)
+			} else {
+				val := fmt.Appendf(nil, "%s-%x", key, r.Uint64())
+				val = append(val, make([]byte, r.IntN(MAX_VAL_SIZE - len(val)))...)
+				err = txn.Insert([]byte(key), val)
+				next[key] = val
+			}
+			if err != nil { break }
+		}
+		if err != nil {
+			// nothing got as far as a commit
+			checkErr(err)
+			txn.Rollback()
+			fb.Crash()
+			return durable, nil
+		}
+
+		if r.IntN(8) == 0 {
+			txn.Rollback()
+			continue
+		}
+
+		if err := txn.Commit(); err != nil {
+			checkErr(err)
+			fb.Crash()
+			return durable, next
+		}
+		durable = next
+	}
+	return durable, nil
+}
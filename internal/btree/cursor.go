@@ -0,0 +1,353 @@
+package btree
+
+import (
+	c "mooodb/internal"
+	"bytes"
+	"context"
+	"iter"
+	"mooodb/internal/btree/page"
+	"mooodb/internal/pager"
+)
+
+const CURSOR_STACK_DEPTH = 64
+
+// How many siblings ahead of a scan get prefetched
+const CURSOR_PREFETCH = 8
+type CursorCrumb struct {
+	pageId 	uint64
+	slot	uint16
+	_		[6]byte
+}
+
+// A Cursor walks the tree in key order. It keeps a crumb (page, slot) for every level from
+// the root down to the leaf it is on, and moves between leaves by climbing that stack until
+// an ancestor has a neighbouring child to go down into. Leaf Right links can't be used for
+// this, under CoW they go stale as soon as a neighbour is copied.
+//
+// Once a cursor starts moving between leaves (First/Last, or Next/Prev off the end of one)
+// it prefetches the children that come after the one it goes down into, so the next leaves
+// are already being read by the time it gets to them. Seek alone doesn't, point lookups
+// shouldn't pay for it.
+//
+// Pages are never modified in place, but they are reused once retired, so a cursor always
+// reads through a Txn that keeps its snapshot around. One from Txn.Cursor uses that
+// transaction's. One from CreateCursor begins a read transaction of its own every time it
+// starts from the root (Seek, First, Last), on whatever the latest commit is then, and ends
+// it in Close - until then the pages it can see aren't reused, so close it when done.
+type Cursor struct {
+	btree		*Btree
+	txn 		*Txn
+	ownTxn 		bool // txn was begun by the cursor itself, and ends with Close
+	stack	[CURSOR_STACK_DEPTH]CursorCrumb
+	stackPtr	int // level of the leaf
+
+	frame 		*pager.Frame // leaf the cursor is on, pinned until the cursor moves or closes
+	valid 		bool // whether the cursor is on an entry
+	err 		error // from the last Range
+}
+
+func CreateCursor(btree *Btree) *Cursor {
+	return &Cursor{
+		btree: btree,
+	}
+}
+
+// Unpins whatever the cursor is holding, and ends its own read transaction if it has one.
+// The cursor can still be re-used by seeking again.
+func (crs *Cursor) Close() {
+	if crs.frame != nil {
+		crs.frame.Release()
+		crs.frame = nil
+	}
+	crs.valid = false
+
+	if crs.ownTxn {
+		crs.txn.Rollback()
+		crs.txn = nil
+		crs.ownTxn = false
+	}
+}
+
+// Whether the cursor is on an entry
+func (crs *Cursor) Valid() bool {
+	return crs.valid
+}
+
+// Key under the cursor, nil if it isn't on an entry. Points into the page - only valid until
+// the cursor moves.
+func (crs *Cursor) Key() []byte {
+	if !crs.valid { return nil }
+	leaf := crs.leaf()
+	return leaf.KeyAt(crs.stack[crs.stackPtr].slot)
+}
+
+// Value under the cursor, nil if it isn't on an entry. Points into the page - only valid
+// until the cursor moves.
+func (crs *Cursor) Value() []byte {
+	if !crs.valid { return nil }
+	leaf := crs.leaf()
+	return leaf.ValAt(crs.stack[crs.stackPtr].slot)
+}
+
+// Error that ended the last Range early, if any
+func (crs *Cursor) Err() error {
+	return crs.err
+}
+
+// Positions the cursor on the first key >= key, returns whether exact key was found or not.
+// If every key is smaller the cursor ends up not Valid.
+//
+// Inner pages are unpinned as soon as we've stepped past them, only the leaf stays pinned.
+func (crs *Cursor) Seek(key []byte) (bool, error) {
+	crs.Close()
+	crs.stackPtr = 0
+
+	pageId := crs.rootId()
+	for {
+		frame, err := crs.load(pageId)
+		if err != nil { return false, err }
+		curPage := page.PageSlottedFrom(frame.BufferHandle())
+		crs.stack[crs.stackPtr].pageId = pageId
+
+		if curPage.IsTypeLeaf() {
+			crs.frame = frame
+			break
+		}
+
+		var slot int
+		var pageIdVal []byte
+		if curPage.IsTypeInner() && crs.stackPtr < CURSOR_STACK_DEPTH-1 {
+			pageIdVal, slot = curPage.GetLargestLessEq(key)
+		} else {
+			slot = -1
+		}
+		if slot < 0 {
+			frame.Release()
+			return false, BtreeErrorCorrupt
+		}
+
+		crs.stack[crs.stackPtr].slot = uint16(slot)
+		crs.stackPtr += 1
+
+		pageId = c.Bin.Uint64(pageIdVal)
+		frame.Release()
+	}
+
+	// now we're at a leaf page
+
+	curPage := crs.leaf()
+	slot, found := curPage.Find(key)
+	if slot < curPage.EntryCount() {
+		crs.stack[crs.stackPtr].slot = slot
+		crs.valid = true
+		return found, nil
+	}
+
+	// everything on this leaf is smaller, so it's the first key of the next one
+	crs.valid = true
+	_, err := crs.step(true)
+	return false, err
+}
+
+// Positions the cursor on the smallest key, returns false if the tree is empty
+func (crs *Cursor) First() (bool, error) {
+	return crs.end(false)
+}
+
+// Positions the cursor on the largest key, returns false if the tree is empty
+func (crs *Cursor) Last() (bool, error) {
+	return crs.end(true)
+}
+
+// Moves to the next key, returns false (and stops being Valid) once past the last one
+func (crs *Cursor) Next() (bool, error) {
+	if !crs.valid { return false, nil }
+
+	leaf := crs.leaf()
+	crumb := &crs.stack[crs.stackPtr]
+	if crumb.slot + 1 < leaf.EntryCount() {
+		crumb.slot++
+		return true, nil
+	}
+	return crs.step(true)
+}
+
+// Moves to the previous key, returns false (and stops being Valid) once past the first one
+func (crs *Cursor) Prev() (bool, error) {
+	if !crs.valid { return false, nil }
+
+	crumb := &crs.stack[crs.stackPtr]
+	if crumb.slot > 0 {
+		crumb.slot--
+		return true, nil
+	}
+	return crs.step(false)
+}
+
+// Every pair with start <= key < end, in key order. A nil start or end means unbounded.
+//
+// The slices point into the page and are only valid until the next iteration. An error
+// stops the iteration early and is left in Err.
+func (crs *Cursor) Range(start []byte, end []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		var ok bool
+		var err error
+		if start == nil {
+			ok, err = crs.First()
+		} else {
+			_, err = crs.Seek(start)
+			ok = crs.valid
+		}
+
+		for ok && err == nil {
+			key := crs.Key()
+			if end != nil && bytes.Compare(key, end) >= 0 { break }
+			if !yield(key, crs.Value()) { break }
+			ok, err = crs.Next()
+		}
+		crs.err = err
+	}
+}
+
+func (crs *Cursor) context() context.Context {
+	if crs.txn != nil { return crs.txn.ctx }
+	return context.Background()
+}
+
+// Root to start a descent from. Begins the cursor's own read transaction if it doesn't have
+// one, so only call it after Close.
+func (crs *Cursor) rootId() uint64 {
+	if crs.txn == nil {
+		crs.txn = crs.btree.BeginRead()
+		crs.ownTxn = true
+	}
+	return crs.txn.rootId
+}
+
+func (crs *Cursor) leaf() page.PageSlotted {
+	return page.PageSlottedFrom(crs.frame.BufferHandle())
+}
+
+func (crs *Cursor) load(pageId uint64) (*pager.Frame, error) {
+	frame, err := crs.btree.pager.GetPageCtx(crs.context(), pageId)
+	if err != nil { return nil, err }
+	if err := frame.Wait(); err != nil {
+		frame.Release()
+		return nil, err
+	}
+	return frame, nil
+}
+
+// Prefetches the children of inner page pg that come after slot (before it going backwards).
+// pg must still be pinned.
+func (crs *Cursor) prefetch(pg page.PageSlotted, slot int, forward bool) {
+	var ids [CURSOR_PREFETCH]uint64
+	cnt := 0
+	for i := 1; i <= CURSOR_PREFETCH; i++ {
+		next := slot + i
+		if !forward { next = slot - i }
+		if next < 0 || next >= int(pg.EntryCount()) { break }
+		ids[cnt] = c.Bin.Uint64(pg.ValAt(uint16(next)))
+		cnt++
+	}
+	if cnt > 0 {
+		crs.btree.pager.Prefetch(ids[:cnt]...)
+	}
+}
+
+// First or last key of the whole tree
+func (crs *Cursor) end(last bool) (bool, error) {
+	crs.Close()
+
+	if err := crs.descend(0, crs.rootId(), last); err != nil { return false, err }
+
+	if leaf := crs.leaf(); leaf.EntryCount() > 0 {
+		crs.valid = true
+		return true, nil
+	}
+
+	// only an empty root leaf should get us here, but keep walking just in case
+	crs.valid = true
+	return crs.step(!last)
+}
+
+// Goes down from pageId (at level) to its first or last leaf, leaving that leaf pinned with
+// the cursor on its first or last slot.
+func (crs *Cursor) descend(level int, pageId uint64, last bool) error {
+	for {
+		frame, err := crs.load(pageId)
+		if err != nil { return err }
+		pg := page.PageSlottedFrom(frame.BufferHandle())
+		crs.stack[level].pageId = pageId
+
+		cnt := pg.EntryCount()
+		var slot uint16
+		if last && cnt > 0 {
+			slot = cnt - 1
+		}
+		crs.stack[level].slot = slot
+
+		if pg.IsTypeLeaf() {
+			crs.frame = frame
+			crs.stackPtr = level
+			return nil
+		}
+
+		if !pg.IsTypeInner() || cnt == 0 || level == CURSOR_STACK_DEPTH-1 {
+			frame.Release()
+			return BtreeErrorCorrupt
+		}
+
+		crs.prefetch(pg, int(slot), !last)
+		pageId = c.Bin.Uint64(pg.ValAt(slot))
+		frame.Release()
+		level++
+	}
+}
+
+// Moves to the first entry of the next leaf (or last of the previous one), skipping over
+// any empty leaves. Returns false (and invalidates the cursor) if there isn't one.
+func (crs *Cursor) step(forward bool) (bool, error) {
+	for {
+		crs.frame.Release()
+		crs.frame = nil
+
+		// climb until some ancestor has a child next to the one we came from
+		level := crs.stackPtr - 1
+		var childId uint64
+		for ; level >= 0; level-- {
+			frame, err := crs.load(crs.stack[level].pageId)
+			if err != nil {
+				crs.valid = false
+				return false, err
+			}
+			pg := page.PageSlottedFrom(frame.BufferHandle())
+
+			slot := int(crs.stack[level].slot)
+			if forward { slot++ } else { slot-- }
+
+			found := slot >= 0 && slot < int(pg.EntryCount())
+			if found {
+				crs.stack[level].slot = uint16(slot)
+				childId = c.Bin.Uint64(pg.ValAt(uint16(slot)))
+				crs.prefetch(pg, slot, forward)
+			}
+			frame.Release()
+			if found { break }
+		}
+
+		if level < 0 {
+			crs.valid = false
+			return false, nil
+		}
+
+		if err := crs.descend(level+1, childId, !forward); err != nil {
+			crs.valid = false
+			return false, err
+		}
+
+		if leaf := crs.leaf(); leaf.EntryCount() > 0 {
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package btree
+
+import (
+	"mooodb/internal/pager"
+
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fillTestBtree(t *testing.T, bt *Btree, n int) []string {
+	var keys []string
+	for i := range n {
+		key := fmt.Sprintf("key%05d", i)
+		keys = append(keys, key)
+		if err := bt.Insert([]byte(key), []byte("val" + key)); err != nil { t.Fatal(err) }
+	}
+	return keys
+}
+
+func Test_Cursor_Forward_Backward(t *testing.T) {
+	// small pool - leaking pins would run us out of frames quickly
+	btree := createTestBtree(t, 16)
+	keys := fillTestBtree(t, btree, 2000)
+
+	crs := CreateCursor(btree)
+	defer crs.Close()
+
+	var got []string
+	ok, err := crs.First()
+	for ; ok && err == nil; ok, err = crs.Next() {
+		got = append(got, string(crs.Key()))
+		assert.Equal(t, "val" + string(crs.Key()), string(crs.Value()))
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, keys, got)
+	assert.False(t, crs.Valid())
+	assert.Nil(t, crs.Key())
+
+	got = got[:0]
+	ok, err = crs.Last()
+	for ; ok && err == nil; ok, err = crs.Prev() {
+		got = append(got, string(crs.Key()))
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, len(keys), len(got))
+	for i := range got {
+		assert.Equal(t, keys[len(keys)-1-i], got[i])
+	}
+}
+
+func Test_Cursor_Seek(t *testing.T) {
+	btree := createTestBtree(t, 16)
+	fillTestBtree(t, btree, 1000)
+
+	crs := CreateCursor(btree)
+	defer crs.Close()
+
+	found, err := crs.Seek([]byte("key00500"))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "key00500", string(crs.Key()))
+
+	// lands on the next key
+	found, err = crs.Seek([]byte("key00500a"))
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Equal(t, "key00501", string(crs.Key()))
+
+	ok, err := crs.Prev()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "key00500", string(crs.Key()))
+
+	found, err = crs.Seek([]byte("a"))
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Equal(t, "key00000", string(crs.Key()))
+
+	// past the end
+	found, err = crs.Seek([]byte("zzz"))
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.False(t, crs.Valid())
+}
+
+func Test_Cursor_Range(t *testing.T) {
+	btree := createTestBtree(t, 16)
+	keys := fillTestBtree(t, btree, 1000)
+
+	crs := CreateCursor(btree)
+	defer crs.Close()
+
+	var got []string
+	for k, v := range crs.Range([]byte("key00100"), []byte("key00900")) {
+		assert.Equal(t, "val" + string(k), string(v))
+		got = append(got, string(k))
+	}
+	assert.NoError(t, crs.Err())
+	assert.Equal(t, keys[100:900], got)
+
+	got = got[:0]
+	for k := range crs.Range(nil, nil) {
+		got = append(got, string(k))
+	}
+	assert.Equal(t, keys, got)
+
+	got = got[:0]
+	for k := range crs.Range([]byte("key00990"), nil) {
+		got = append(got, string(k))
+	}
+	assert.Equal(t, keys[990:], got)
+
+	// empty
+	for range crs.Range([]byte("key00500"), []byte("key00500")) {
+		t.Fatal("shouldn't yield")
+	}
+
+	// breaking out early leaves the cursor where it was
+	for k := range crs.Range(nil, nil) {
+		if string(k) == "key00042" { break }
+	}
+	assert.Equal(t, "key00042", string(crs.Key()))
+}
+
+func Test_Cursor_Empty(t *testing.T) {
+	btree := createTestBtree(t, 16)
+
+	crs := CreateCursor(btree)
+	defer crs.Close()
+
+	ok, err := crs.First()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = crs.Last()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	for range crs.Range(nil, nil) {
+		t.Fatal("shouldn't yield")
+	}
+
+	// deleted down to nothing again
+	fillTestBtree(t, btree, 500)
+	for i := range 500 {
+		if _, err := btree.Delete(fmt.Appendf(nil, "key%05d", i)); err != nil { t.Fatal(err) }
+	}
+	ok, err = crs.First()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func Test_Cursor_Snapshot(t *testing.T) {
+	btree := createTestBtree(t, 16)
+	keys := fillTestBtree(t, btree, 500)
+
+	// a cursor without a txn still keeps the pages it's walking from being reused
+	crs := CreateCursor(btree)
+	ok, err := crs.First()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	got := []string{string(crs.Key())}
+
+	for i, key := range keys {
+		if i % 2 == 0 {
+			if _, err := btree.Delete([]byte(key)); err != nil { t.Fatal(err) }
+		} else {
+			if err := btree.Insert([]byte(key), bytes.Repeat([]byte{'x'}, 100)); err != nil { t.Fatal(err) }
+		}
+	}
+	checkPageAccounting(t, btree)
+
+	for {
+		ok, err := crs.Next()
+		if err != nil { t.Fatal(err) }
+		if !ok { break }
+		assert.Equal(t, "val" + string(crs.Key()), string(crs.Value()))
+		got = append(got, string(crs.Key()))
+	}
+	assert.Equal(t, keys, got)
+
+	// closing it lets them go, and seeking again sees the latest commit
+	crs.Close()
+	assert.Equal(t, btree.gen, btree.oldestReader())
+	found, err := crs.Seek([]byte("key00001"))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, bytes.Repeat([]byte{'x'}, 100), crs.Value())
+	crs.Close()
+}
+
+func Test_Cursor_Queue_For_Frames(t *testing.T) {
+	// far more cursors than frames - they have to take turns rather than fail
+	btree := createTestBtree(t, 16)
+	keys := fillTestBtree(t, btree, 1000)
+
+	const CURSORS = 64
+	errs := make(chan error, CURSORS)
+	for range CURSORS {
+		go func() {
+			txn := btree.BeginRead()
+			defer txn.Rollback()
+			crs := txn.Cursor()
+			defer crs.Close()
+
+			n := 0
+			for range crs.Range(nil, nil) {
+				n++
+				runtime.Gosched()
+			}
+			if crs.Err() == nil && n != len(keys) {
+				errs <- fmt.Errorf("saw %d keys", n)
+				return
+			}
+			errs <- crs.Err()
+		}()
+	}
+	for range CURSORS {
+		assert.NoError(t, <-errs)
+	}
+
+	// and give up when told to
+	var pinned []*pager.Frame
+	for {
+		frame := btree.pager.CreatePage()
+		if frame == nil { break }
+		pinned = append(pinned, frame)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+	defer cancel()
+	txn := btree.BeginReadCtx(ctx)
+	_, _, err := txn.Get([]byte("key00000"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	txn.Rollback()
+	for _, frame := range pinned {
+		frame.Release()
+	}
+}
@@ -0,0 +1,169 @@
+package btree
+
+import (
+	"mooodb/internal/btree/page"
+	"mooodb/internal/pager"
+)
+
+// Pages dropped from the tree by a commit. Anyone still reading an older generation can see
+// them, so they can't be handed back to the pager until those readers are gone.
+type retiredPages struct {
+	gen 	uint64 // the commit that dropped them
+	ids 	[]uint64
+}
+
+// Flushes a write set and commits it with rootId as the new root, along with a fresh copy of
+// the free-list.
+//
+// The persisted free-list holds every page the new tree doesn't use - ones the pager is
+// waiting to reuse as well as ones still pending on readers (after a restart there are no
+// readers, so they're all reusable). The previous free-list's pages are dropped by this
+// commit like any other.
+//
+// Up to the meta page write, a failure leaves the previous commit untouched on disk, so the
+// write set is thrown away like a rollback would. Past that point the new meta page might
+// have made it, and we can't hand out any of its pages again.
+func (bt *Btree) commit(ws *writeSet, rootId uint64) error {
+	retired := append(ws.retired, bt.freeList...)
+
+	head, chain, err := bt.writeFreeList(ws, retired)
+	if err == nil {
+		// everything the new root can reach, plus the free-list, in one go
+		err = bt.pager.Flush(ws.gen)
+	}
+	if err == nil {
+		err = bt.pager.Sync()
+	}
+	if err != nil {
+		ws.discard()
+		return err
+	}
+
+	if err := bt.publish(rootId, ws.gen, head); err != nil { return err }
+
+	bt.freeList = chain
+	bt.pending = append(bt.pending, retiredPages{ gen: ws.gen, ids: retired })
+	bt.reclaim()
+
+	return nil
+}
+
+// Hands retired pages back to the pager once nobody can see them anymore
+func (bt *Btree) reclaim() {
+	oldest := bt.oldestReader()
+
+	n := 0
+	for n < len(bt.pending) && bt.pending[n].gen <= oldest {
+		bt.pager.Reuse(bt.pending[n].ids...)
+		n++
+	}
+	bt.pending = bt.pending[n:]
+}
+
+// Oldest generation anyone could still be reading - the oldest snapshot that still has
+// readers, or the latest commit. Snapshots nobody is on anymore are dropped along the way.
+// Writer only.
+func (bt *Btree) oldestReader() uint64 {
+	cur := bt.current.Load()
+	oldest := cur.gen
+
+	n := 0
+	for _, snap := range bt.snapshots {
+		if snap != cur && snap.readers.Load() == 0 { continue }
+		oldest = min(oldest, snap.gen)
+		bt.snapshots[n] = snap
+		n++
+	}
+	clear(bt.snapshots[n:])
+	bt.snapshots = bt.snapshots[:n]
+
+	return oldest
+}
+
+// Writes the free-list out to a chain of free pages (well, marks them dirty). Returns the
+// head of the chain (0 if the list is empty) and the ids of the pages in it. The pages are
+// taken for ws, so they go back to the pager with everything else if the commit fails.
+func (bt *Btree) writeFreeList(ws *writeSet, retired []uint64) (uint64, []uint64, error) {
+	var frames []*pager.Frame
+	defer func() {
+		for _, frame := range frames {
+			frame.Release()
+		}
+	}()
+
+	// the chain's own pages can come out of the reusable ids, which shrinks the list, so
+	// work out what to store only once we have enough pages
+	var ids []uint64
+	for {
+		ids = bt.pager.Reusable()
+		for _, pending := range bt.pending {
+			ids = append(ids, pending.ids...)
+		}
+		ids = append(ids, retired...)
+
+		if len(frames) * page.FreeListCapacity >= len(ids) {
+			break
+		}
+
+		frame, err := bt.pager.CreatePageCtx(ws.ctx)
+		if err != nil { return 0, nil, err }
+		frames = append(frames, frame)
+		ws.created = append(ws.created, frame.PageId())
+	}
+
+	chain := make([]uint64, len(frames))
+	for i, frame := range frames {
+		chain[i] = frame.PageId()
+	}
+
+	for i, frame := range frames {
+		pg := page.PageFreeNew(frame.BufferHandle(), frame.PageId(), ws.gen)
+		ids = pg.SetIds(ids)
+		if i+1 < len(frames) {
+			pg.SetNext(chain[i+1])
+		}
+		pg.DoChecksum()
+		frame.MarkDirty(ws.gen)
+	}
+
+	if len(chain) == 0 {
+		return 0, nil, nil
+	}
+	return chain[0], chain, nil
+}
+
+// Loads the free-list of the latest commit and hands all of it to the pager - there are no
+// readers yet, so everything on it is reusable right away.
+func (bt *Btree) readFreeList() error {
+	var ids []uint64
+	var chain []uint64
+
+	pageId := bt.meta().FreeList()
+	for pageId != 0 {
+		// a chain can't be longer than the file, if it is we're going around in circles
+		if uint64(len(chain)) >= bt.meta().PageCnt() { return BtreeErrorCorrupt }
+
+		frame := bt.pager.GetPage(pageId)
+		if frame == nil { return BtreeErrorFrame }
+		if err := frame.Wait(); err != nil {
+			frame.Release()
+			return err
+		}
+
+		pg := page.PageFreeFrom(frame.BufferHandle())
+		// the pager already checked the id and checksum
+		if !pg.IsTypeFree() {
+			frame.Release()
+			return BtreeErrorCorrupt
+		}
+
+		chain = append(chain, pageId)
+		ids = pg.Ids(ids)
+		pageId = pg.Next()
+		frame.Release()
+	}
+
+	bt.freeList = chain
+	bt.pager.Reuse(ids...)
+	return nil
+}
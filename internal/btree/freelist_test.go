@@ -0,0 +1,159 @@
+package btree
+
+import (
+	c "mooodb/internal"
+	"mooodb/internal/btree/page"
+	"mooodb/internal/pager"
+
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Every page id below NextId has to be exactly one of: a meta page, a tree page, a page of
+// the persisted free-list, or a free id (reusable or pending).
+func checkPageAccounting(t *testing.T, bt *Btree) {
+	owner := make(map[uint64]string)
+	claim := func(pageId uint64, what string) {
+		if prev, found := owner[pageId]; found {
+			t.Fatalf("page %d is both %s and %s", pageId, prev, what)
+		}
+		owner[pageId] = what
+	}
+
+	for i := range META_PAGE_CNT {
+		claim(uint64(i), "meta")
+	}
+
+	var walk func(pageId uint64)
+	walk = func(pageId uint64) {
+		claim(pageId, "tree")
+		frame := bt.pager.GetPage(pageId)
+		if err := frame.Wait(); err != nil { t.Fatal(err) }
+		pg := page.PageSlottedFrom(frame.BufferHandle())
+		var children []uint64
+		if pg.IsTypeInner() {
+			for i := range pg.EntryCount() {
+				children = append(children, c.Bin.Uint64(pg.ValAt(i)))
+			}
+		}
+		frame.Release()
+		for _, child := range children {
+			walk(child)
+		}
+	}
+	walk(bt.meta().RootId())
+
+	for _, pageId := range bt.freeList {
+		claim(pageId, "free-list")
+	}
+	for _, pageId := range bt.pager.Reusable() {
+		claim(pageId, "reusable")
+	}
+	for _, pending := range bt.pending {
+		for _, pageId := range pending.ids {
+			claim(pageId, "pending")
+		}
+	}
+
+	nextId := bt.pager.NextId()
+	for pageId := range nextId {
+		if _, found := owner[pageId]; !found {
+			t.Fatalf("page %d leaked", pageId)
+		}
+	}
+	assert.Equal(t, int(nextId), len(owner))
+}
+
+func Test_FreeList_Reuse(t *testing.T) {
+	btree := createTestBtree(t, 32)
+
+	r := rand.New(rand.NewPCG(5, 6))
+	for i := range 500 {
+		key := fmt.Appendf(nil, "%06d", i)
+		if err := btree.Insert(key, bytes.Repeat([]byte{'a'}, 40)); err != nil { t.Fatal(err) }
+	}
+	checkPageAccounting(t, btree)
+	sizeBefore := btree.pager.NextId()
+
+	// churn - without reuse every one of these would add a whole path to the file
+	for i := range 3000 {
+		key := fmt.Appendf(nil, "%06d", r.IntN(600))
+		var err error
+		if i % 3 == 0 {
+			_, err = btree.Delete(key)
+		} else {
+			err = btree.Insert(key, bytes.Repeat([]byte{'b'}, r.IntN(80)))
+		}
+		if err != nil { t.Fatal(err) }
+	}
+	checkPageAccounting(t, btree)
+
+	assert.Less(t, btree.pager.NextId(), sizeBefore * 2, "file should stop growing")
+}
+
+func Test_FreeList_Reopen(t *testing.T) {
+	fp := memfile()
+
+	pgr, err := pager.CreatePagerWith(memfs.Open, fp, 32)
+	if err != nil { t.Fatal(err) }
+	btree, err := CreateBtree(pgr)
+	if err != nil { t.Fatal(err) }
+
+	// enough garbage for the free-list to take more than one page
+	for round := range 4 {
+		for i := range 600 {
+			key := fmt.Appendf(nil, "%06d", i)
+			if err := btree.Insert(key, bytes.Repeat([]byte{byte(round)}, 60)); err != nil { t.Fatal(err) }
+		}
+	}
+	for i := range 600 {
+		if i % 4 == 0 { continue }
+		if _, err := btree.Delete(fmt.Appendf(nil, "%06d", i)); err != nil { t.Fatal(err) }
+	}
+	checkPageAccounting(t, btree)
+
+	// pretend the file once held a lot more than it does now, so the free-list needs a
+	// few pages to itself
+	end := pgr.NextId()
+	pgr.SetNextId(end + uint64(page.FreeListCapacity) * 2)
+	for pageId := end; pageId < pgr.NextId(); pageId++ {
+		pgr.Reuse(pageId)
+	}
+	if err := btree.Insert([]byte("grow"), nil); err != nil { t.Fatal(err) }
+	checkPageAccounting(t, btree)
+
+	freeCnt := len(btree.pager.Reusable())
+	for _, pending := range btree.pending {
+		freeCnt += len(pending.ids)
+	}
+	freeListLen := len(btree.freeList)
+	assert.Greater(t, freeListLen, 1)
+	nextId := pgr.NextId()
+
+	btree.Close()
+	pgr.Close()
+
+	pgr, err = pager.OpenPagerWith(memfs.Open, fp, 32)
+	if err != nil { t.Fatal(err) }
+	defer pgr.Close()
+	btree, err = OpenBtree(pgr)
+	if err != nil { t.Fatal(err) }
+	defer btree.Close()
+
+	assert.Equal(t, freeCnt, len(pgr.Reusable()))
+	assert.Equal(t, freeListLen, len(btree.freeList))
+	checkPageAccounting(t, btree)
+
+	// everything new should come out of the free pages
+	for i := range 600 {
+		if i % 4 != 0 { continue }
+		key := fmt.Appendf(nil, "%06d", i)
+		if err := btree.Insert(key, []byte("reopened")); err != nil { t.Fatal(err) }
+	}
+	assert.Equal(t, nextId, pgr.NextId())
+	checkPageAccounting(t, btree)
+}
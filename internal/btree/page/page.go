@@ -2,8 +2,6 @@ package page
 
 import (
 	c "mooodb/internal"
-
-	"github.com/cespare/xxhash"
 )
 
 const (
@@ -20,8 +18,8 @@ const (
 	// Common Header (0x00 - 0x1F)
 	headerSize = uint16(0x40)
 
-	offChecksum = 0x00 // 8B
-	offPageID   = 0x08 // 8B
+	offChecksum = c.PAGE_OFF_CHECKSUM // 8B
+	offPageID   = c.PAGE_OFF_ID // 8B
 	offGen      = 0x10 // 8B CoW generation
 	offPagetype = 0x18 // 1B
 	offVer      = 0x19 // 1B
@@ -36,9 +34,17 @@ type Page struct {
 }
 
 func (p *Page) DoChecksum() {
-	p.SetChecksum(xxhash.Sum64(p.raw[c.LEN_U64:c.PAGE_SIZE]))
+	p.SetChecksum(p.ComputeChecksum())
+}
+
+// What the checksum should be for the current page contents
+func (p *Page) ComputeChecksum() uint64 {
+	return c.PageChecksum(p.raw)
 }
 
+// The whole underlying page buffer
+func (p *Page) Raw() []byte				{ return p.raw }
+
 // common
 func (p *Page) Checksum() uint64 		{ return c.Bin.Uint64(p.raw[offChecksum:]) }
 func (p *Page) Id() uint64       		{ return c.Bin.Uint64(p.raw[offPageID:]) }
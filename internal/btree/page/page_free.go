@@ -0,0 +1,65 @@
+package page
+
+import (
+	c "mooodb/internal"
+)
+
+// A page that nothing points to anymore. There is no notion of deleting a page at the file
+// level, so pages that are dropped from the tree get written out as one of these.
+//
+// Free pages also make up the persisted free-list: a chain (linked through Next) of pages
+// each holding a run of free page ids, rooted at PageMeta.FreeList.
+type PageFree struct {
+	Page
+}
+
+func PageFreeNew(raw []byte, pageId uint64, gen uint64) PageFree {
+	p := PageFree{Page: Page{raw: raw}}
+
+	p.SetId(pageId)
+	p.SetVer(Version)
+	p.SetPagetype(PagetypeFree)
+	p.SetFlags(0)
+	p.SetGen(gen)
+	p.SetNext(0)
+	p.setCount(0)
+	return p
+}
+
+func PageFreeFrom(raw []byte) PageFree {
+	return PageFree{Page: Page{raw: raw}}
+}
+
+const (
+	// Free Metadata (0x20 - 0x3F)
+	offNext 	= 0x20 // 8B next page in the free-list chain, 0 if none
+	offCount 	= 0x28 // 4B
+	// reserved 0x2c.., 20B
+)
+
+// How many page ids fit on one free-list page
+const FreeListCapacity = int(c.PAGE_SIZE - headerSize) / c.LEN_U64
+
+func (p *PageFree) Next() uint64 			{ return c.Bin.Uint64(p.raw[offNext:]) }
+func (p *PageFree) Count() int 				{ return int(c.Bin.Uint32(p.raw[offCount:])) }
+func (p *PageFree) SetNext(next uint64) 	{ c.Bin.PutUint64(p.raw[offNext:], next) }
+func (p *PageFree) setCount(cnt int) 		{ c.Bin.PutUint32(p.raw[offCount:], uint32(cnt)) }
+
+// Appends the ids stored on this page to ids
+func (p *PageFree) Ids(ids []uint64) []uint64 {
+	cnt := min(p.Count(), FreeListCapacity)
+	for i := range cnt {
+		ids = append(ids, c.Bin.Uint64(p.raw[int(headerSize) + i*c.LEN_U64:]))
+	}
+	return ids
+}
+
+// Stores as many of ids as fit, returns the ones that didn't
+func (p *PageFree) SetIds(ids []uint64) []uint64 {
+	cnt := min(len(ids), FreeListCapacity)
+	for i := range cnt {
+		c.Bin.PutUint64(p.raw[int(headerSize) + i*c.LEN_U64:], ids[i])
+	}
+	p.setCount(cnt)
+	return ids[cnt:]
+}
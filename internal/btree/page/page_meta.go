@@ -34,6 +34,7 @@ const (
 	offFreeList		= 0x38
 )
 
+func (p *PageMeta) MagicOk() bool 			{ return string(p.raw[offMagic:offMagic+len(magic)]) == magic }
 func (p *PageMeta) RootId() uint64      	{ return c.Bin.Uint64(p.raw[offRootId:]) }
 func (p *PageMeta) PageCnt() uint64      	{ return c.Bin.Uint64(p.raw[offPageCnt:]) }
 func (p *PageMeta) FreeList() uint64      	{ return c.Bin.Uint64(p.raw[offFreeList:]) }
@@ -33,7 +33,9 @@ func PageSlottedNew(raw []byte, id uint64, leaf bool, gen uint64, parent uint64)
 
 	p.SetId(id)
 	p.SetVer(Version)
+	p.SetFlags(0)
 	p.SetParent(parent)
+	p.SetRight(0)
 	p.SetGen(gen)
 	p.initializePtrs()
 
@@ -45,6 +47,9 @@ func PageSlottedFrom(raw []byte) PageSlotted {
 	return PageSlotted{Page: Page{raw: raw}}
 }
 
+// Bytes available for slots+entries on an empty page
+const SlottedCapacity = c.PAGE_SIZE - headerSize
+
 const (
 	// Slotted Metadata (0x20 - 0x3F)
 	offUpper  = 0x20 // 2B
@@ -92,6 +97,12 @@ func (p *PageSlotted) Seek(key []byte) int {
 	return int(slotIndex)
 }
 
+// Returns (slotIndex, found). Binary searches through keys stored in page - if not found the
+// index is where key would go, ie. the first slot with a greater key (or EntryCount).
+func (p *PageSlotted) Find(key []byte) (uint16, bool) {
+	return p.keyToSlotIndex(key)
+}
+
 // Finds smallest key that is greater than search key, and returns value.
 func (p *PageSlotted) GetSmallestGreater(key []byte) ([]byte, int) {
 	assert.True(p.IsTypeInner())
@@ -103,6 +114,34 @@ func (p *PageSlotted) GetSmallestGreater(key []byte) ([]byte, int) {
 	return p.slotIndexToVal(slotIndex), int(slotIndex)
 }
 
+// Finds largest key that is less than or equal to search key, and returns value.
+//
+// Inner pages store the lowest key reachable through each child, so this is the child a
+// search key should descend into.
+func (p *PageSlotted) GetLargestLessEq(key []byte) ([]byte, int) {
+	assert.True(p.IsTypeInner())
+
+	slotIndex, found := p.keyToSlotIndex(key)
+	if !found {
+		if slotIndex == 0 {
+			return nil, -1
+		}
+		slotIndex--
+	}
+	return p.slotIndexToVal(slotIndex), int(slotIndex)
+}
+
+// Key stored at slot - the slice points into the page
+func (p *PageSlotted) KeyAt(slotIndex uint16) []byte {
+	return p.slotIndexToKey(slotIndex)
+}
+
+// Value stored at slot - the slice points into the page, so writing through it (without
+// changing its length) modifies the entry in place
+func (p *PageSlotted) ValAt(slotIndex uint16) []byte {
+	return p.slotIndexToVal(slotIndex)
+}
+
 // Lazy - bool if found
 func (p *PageSlotted) Delete(key []byte) bool {
 	slotIndex, found := p.keyToSlotIndex(key)
@@ -140,15 +179,12 @@ func (p *PageSlotted) Put(key []byte, val []byte) (bool, bool) {
 	slotIndex, found := p.keyToSlotIndex(key)
 	slotOff := p.slotIndexToSlotOffset(slotIndex)
 
-	// subtract space from slot now so space checks are accurate after
-	p.setFreebytes(p.freeBytes() - c.LEN_U16)
-
 	insertInPlace := false
 
+	// All space checks happen before we touch the page, so a failed Put leaves it untouched
 	if !found {
-		// entry won't fit
-		if entryLen > p.FreeBytesContig() {
-			p.setFreebytes(p.freeBytes() + c.LEN_U16) // TODO: Clean this up
+		// entry (and its new slot) won't fit
+		if entryLen+c.LEN_U16 > p.FreeBytesContig() {
 			return false, false
 		}
 		// bump all slots starting at and including slotIndex
@@ -158,14 +194,18 @@ func (p *PageSlotted) Put(key []byte, val []byte) (bool, bool) {
 			p.raw[slotOff:slotEndOff],
 		)
 		p.setUpper(p.upper() + c.LEN_U16)
-		p.setFreebytes(p.freeBytes() - entryLen)
+		p.setFreebytes(p.freeBytes() - entryLen - c.LEN_U16)
 
 	} else {
 		entryLenOld := p.slotIndexToEntryLen(slotIndex)
 		if entryLenOld >= entryLen {
 			insertInPlace = true
-			p.setFreebytes(p.freeBytes() + entryLen - entryLenOld)
+		} else if p.FreeBytesContig() < entryLen {
+			// we dont have enough (contiguous) free space 
+			return true, false
 		}
+		// old entry becomes fragmented free space, new entry is taken out of it
+		p.setFreebytes(p.freeBytes() + entryLenOld - entryLen)
 	}
 
 	var entryOff uint16
@@ -174,10 +214,6 @@ func (p *PageSlotted) Put(key []byte, val []byte) (bool, bool) {
 		// we can just overwrite the old entry in place to (somewhat) reduce fragmentation
 		entryOff = p.slotIndexToEntryOffset(slotIndex)
 	} else {
-		if p.FreeBytesContig() < entryLen {
-			// we dont have enough (contiguous) free space 
-			return found, false
-		}
 		entryOff = p.lower() - entryLen + 1
 	}
 
@@ -265,6 +301,11 @@ func (p *PageSlotted) FreeBytesFrag() uint16 {
 	return p.freeBytes()
 }
 
+// Bytes taken up by live slots+entries, ie what would be left after defragmenting
+func (p *PageSlotted) UsedBytes() uint16 {
+	return SlottedCapacity - p.freeBytes()
+}
+
 // Decimal representation of how much of the pages dataspace is used. Header is ignored for this calculation,
 // ie a freshly constructed page will return 0.0 - a page with 0 free bytes will return 1.0
 func (p *PageSlotted) FreeDecim() float64 {
@@ -176,7 +176,7 @@ func Test_PageSlotted_DeleteAndReclaim(t *testing.T) {
 		t.Fatal("Delete failed")
 	}
 
-	if _, found := p.Get(key); found < 0 {
+	if _, found := p.Get(key); found >= 0 {
 		t.Error("Key still exists after deletion")
 	}
 
@@ -242,6 +242,63 @@ func Test_PageSlotted_DeleteAndReclaimFrag(t *testing.T) {
 	}
 }
 
+func Test_PageSlotted_GetLargestLessEq(t *testing.T) {
+	p := PageSlottedNew(make([]byte, c.PAGE_SIZE), 7, false, 1, 0)
+
+	p.Put([]byte{}, []byte("first"))
+	p.Put([]byte("ggg"), []byte("second"))
+	p.Put([]byte("ppp"), []byte("third"))
+
+	cases := map[string]string{
+		"": "first", "aaa": "first", "gg": "first",
+		"ggg": "second", "gggg": "second", "ppo": "second",
+		"ppp": "third", "zzz": "third",
+	}
+	for key, expected := range cases {
+		val, slot := p.GetLargestLessEq([]byte(key))
+		if slot < 0 || string(val) != expected {
+			t.Errorf("key %q - got %q want %q", key, val, expected)
+		}
+	}
+}
+
+func Test_PageSlotted_PutFullUntouched(t *testing.T) {
+	p := PageSlottedNewTest(make([]byte, c.PAGE_SIZE), 0x77)
+
+	var i int
+	for i = 0; ; i++ {
+		if _, ok := p.Put([]byte{byte(i >> 8), byte(i)}, make([]byte, 13)); !ok {
+			break
+		}
+	}
+
+	contig, frag, cnt := p.FreeBytesContig(), p.FreeBytesFrag(), p.EntryCount()
+	if contig != frag {
+		t.Errorf("no fragmentation yet - contig %d frag %d", contig, frag)
+	}
+
+	// entries that would fit without their slot must still be rejected
+	for size := range int(contig) {
+		if _, ok := p.Put([]byte{0xff, 0xff}, make([]byte, size)); ok {
+			if uint16(2 + 2 + 2 + size + 2) > contig {
+				t.Fatalf("size %d shouldn't have fit in %d bytes", size, contig)
+			}
+			p.Delete([]byte{0xff, 0xff})
+			p.Defragment(make([]byte, c.PAGE_SIZE))
+		}
+	}
+
+	if p.EntryCount() != cnt || p.FreeBytesContig() != contig || p.FreeBytesFrag() != frag {
+		t.Errorf("failed puts changed the page")
+	}
+
+	for j := range i {
+		if _, slot := p.Get([]byte{byte(j >> 8), byte(j)}); slot < 0 {
+			t.Fatalf("entry %d missing", j)
+		}
+	}
+}
+
 func Fuzz_PageHeaders_All(f *testing.F) {
 	f.Add(uint64(1), uint64(2), uint16(3), uint16(4),
 		uint64(5), uint8(6), uint16(7), uint8(8), uint64(9), uint16(10))
@@ -320,3 +377,29 @@ func Test_PageMeta_Persistence(t *testing.T) {
 		t.Errorf("Persistence failed: expected 500, got %d", meta2.FreeList())
 	}
 }
+
+func Test_PageFree_Ids(t *testing.T) {
+	p := PageFreeNew(make([]byte, c.PAGE_SIZE), 9, 3)
+
+	ids := make([]uint64, FreeListCapacity + 10)
+	for i := range ids {
+		ids[i] = uint64(i * 7)
+	}
+
+	rest := p.SetIds(ids)
+	if len(rest) != 10 {
+		t.Fatalf("expected 10 ids left over, got %d", len(rest))
+	}
+	p.SetNext(1234)
+
+	p2 := PageFreeFrom(p.raw)
+	got := p2.Ids(nil)
+	if len(got) != FreeListCapacity || p2.Next() != 1234 || !p2.IsTypeFree() {
+		t.Fatalf("free page didn't round trip")
+	}
+	for i := range got {
+		if got[i] != ids[i] {
+			t.Fatalf("id %d - got %d want %d", i, got[i], ids[i])
+		}
+	}
+}
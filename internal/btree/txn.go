@@ -0,0 +1,222 @@
+package btree
+
+import (
+	"bytes"
+	"context"
+	"mooodb/internal/btree/page"
+	"sync/atomic"
+)
+
+// A published commit, and how many read transactions are on it
+type snapshot struct {
+	rootId 		uint64
+	gen 		uint64
+	readers 	atomic.Int64
+}
+
+// A transaction sees the tree as of a single generation.
+//
+// Since pages are never modified in place, a read transaction only has to remember the root
+// it started from - everything under it stays as it was. What it does have to do is keep the
+// pages that later commits drop from being reused while it's still open (see oldestReader),
+// so it must always be ended with Rollback.
+//
+// A write transaction works on the next generation. Every page it touches is copied once,
+// and from then on changed in place until Commit flushes them and publishes the new root.
+// Until then nobody else can see any of it, so Rollback just throws the copies away (if the
+// pager wrote some of them back in the meantime, they went to pages nobody is using).
+type Txn struct {
+	btree 		*Btree
+	ctx 		context.Context // for waiting on frames
+	rootId 		uint64
+	gen 		uint64
+	snap 		*snapshot // read-only transactions
+	ws 			*writeSet // write transactions
+	done 		bool
+}
+
+// Makes the latest commit the one new readers start from. Writer only.
+func (bt *Btree) publishSnapshot() {
+	snap := &snapshot{ rootId: bt.meta().RootId(), gen: bt.gen }
+	bt.snapshots = append(bt.snapshots, snap)
+	bt.current.Store(snap)
+}
+
+// Starts a read-only transaction on the latest commit. Never blocks on writers.
+func (bt *Btree) BeginRead() *Txn {
+	return bt.BeginReadCtx(context.Background())
+}
+
+// Like BeginRead. When the pager runs out of frames the transaction waits for one, until ctx
+// is done - then whatever it was doing fails with ctx's error.
+func (bt *Btree) BeginReadCtx(ctx context.Context) *Txn {
+	// A writer only looks for readers after publishing its commit, so if current hasn't
+	// moved on once we're counted we're sure to be seen. If it has, the writer might have
+	// missed us and reused the pages already - try again with the new one.
+	var snap *snapshot
+	for {
+		snap = bt.current.Load()
+		snap.readers.Add(1)
+		if bt.current.Load() == snap { break }
+		snap.readers.Add(-1)
+	}
+
+	return &Txn{
+		btree: 	bt,
+		ctx: 	ctx,
+		rootId: snap.rootId,
+		gen: 	snap.gen,
+		snap: 	snap,
+	}
+}
+
+// Starts a write transaction on top of the latest commit, waiting for any other one to
+// finish first.
+//
+// Pages are only pinned while an insert or delete is working on them, so the pager needs
+// enough frames for a couple of root-to-leaf paths, not for the whole transaction.
+func (bt *Btree) BeginWrite() *Txn {
+	bt.writeMu.Lock()
+	return bt.beginWrite(context.Background())
+}
+
+// Like BeginWrite, and waits for frames like BeginReadCtx. Doesn't give up on waiting for
+// another write transaction though.
+func (bt *Btree) BeginWriteCtx(ctx context.Context) *Txn {
+	bt.writeMu.Lock()
+	return bt.beginWrite(ctx)
+}
+
+// Like BeginWrite, but fails with TxnErrorBusy instead of waiting.
+func (bt *Btree) TryBeginWrite() (*Txn, error) {
+	if !bt.writeMu.TryLock() { return nil, TxnErrorBusy }
+	return bt.beginWrite(context.Background()), nil
+}
+
+func (bt *Btree) beginWrite(ctx context.Context) *Txn {
+	gen := bt.gen + 1
+	return &Txn{
+		btree: 	bt,
+		ctx: 	ctx,
+		rootId: bt.meta().RootId(),
+		gen: 	gen,
+		ws: 	newWriteSet(ctx, bt, gen),
+	}
+}
+
+// Generation the transaction is reading (or writing)
+func (txn *Txn) Gen() uint64 {
+	return txn.gen
+}
+
+func (txn *Txn) Writable() bool {
+	return txn.ws != nil
+}
+
+// Ends the transaction. Cursors from it must not be used afterwards. Safe to call twice, and
+// after Commit.
+//
+// For a write transaction everything it wrote is discarded and the pages it took go back to
+// the pager.
+func (txn *Txn) Rollback() error {
+	if txn.done { return nil }
+	txn.done = true
+
+	if txn.ws != nil {
+		txn.ws.discard()
+		txn.btree.writeMu.Unlock()
+		return nil
+	}
+
+	txn.snap.readers.Add(-1)
+	return nil
+}
+
+// Writes out everything and publishes the new root. The transaction is done afterwards,
+// whether it worked or not - if it failed before getting to the meta page, it was rolled
+// back.
+func (txn *Txn) Commit() error {
+	if txn.done { return TxnErrorDone }
+	if txn.ws == nil { return TxnErrorReadOnly }
+	txn.done = true
+
+	bt := txn.btree
+	defer bt.writeMu.Unlock()
+	ws := txn.ws
+	defer ws.release()
+
+	// nothing written, nothing to commit
+	if len(ws.created) == 0 && len(ws.retired) == 0 { return nil }
+
+	return bt.commit(ws, txn.rootId)
+}
+
+// Inserts (or overwrites) key. If it fails partway the transaction is rolled back.
+//
+// The first time a page on the root-to-leaf path is touched it is copied into a fresh page
+// stamped with the transaction's generation - the old pages are never touched.
+func (txn *Txn) Insert(key []byte, val []byte) error {
+	if txn.done { return TxnErrorDone }
+	if txn.ws == nil { return TxnErrorReadOnly }
+	if len(key) > MAX_KEY_SIZE { return BtreeErrorKeySize }
+	if len(val) > MAX_VAL_SIZE { return BtreeErrorValSize }
+
+	rootId, err := txn.ws.insert(txn.rootId, key, val)
+	if err != nil {
+		// the pages might be halfway through a split
+		txn.Rollback()
+		return err
+	}
+	txn.ws.done()
+
+	txn.rootId = rootId
+	return nil
+}
+
+// Deletes key, returns whether it existed.
+//
+// Like Insert this copies the path. Pages left underfull are merged with (or take entries
+// from) a sibling, and the root collapses when it is down to a single child.
+func (txn *Txn) Delete(key []byte) (bool, error) {
+	if txn.done { return false, TxnErrorDone }
+	if txn.ws == nil { return false, TxnErrorReadOnly }
+
+	// look first, so a miss doesn't copy the path for nothing
+	_, found, err := txn.Get(key)
+	if err != nil || !found { return false, err }
+
+	rootId, err := txn.ws.delete(txn.rootId, key)
+	if err != nil {
+		txn.Rollback()
+		return false, err
+	}
+	txn.ws.done()
+
+	txn.rootId = rootId
+	return true, nil
+}
+
+// Cursor over the transaction's snapshot. In a write transaction that includes its own
+// writes, and the cursor must not be used across them.
+func (txn *Txn) Cursor() *Cursor {
+	crs := CreateCursor(txn.btree)
+	crs.txn = txn
+	return crs
+}
+
+// Point lookup in the transaction's snapshot (and its own writes), like Btree.Get
+func (txn *Txn) Get(key []byte) ([]byte, bool, error) {
+	if txn.done { return nil, false, TxnErrorDone }
+
+	crs := txn.Cursor()
+	defer crs.Close()
+
+	found, err := crs.Seek(key)
+	if err != nil || !found { return nil, false, err }
+
+	leaf := page.PageSlottedFrom(crs.frame.BufferHandle())
+	val, slot := leaf.Get(key)
+	if slot < 0 { return nil, false, nil }
+
+	return bytes.Clone(val), true, nil
+}
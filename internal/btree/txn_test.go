@@ -0,0 +1,417 @@
+package btree
+
+import (
+	"mooodb/internal/pager"
+	"mooodb/internal/system"
+
+	"bytes"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Txn_Read_Snapshot(t *testing.T) {
+	btree := createTestBtree(t, 16)
+	keys := fillTestBtree(t, btree, 500)
+
+	txn := btree.BeginRead()
+	gen := txn.Gen()
+
+	// rewrite and delete everything under it - without the snapshot holding on to its pages
+	// these would get reused and scribbled over
+	for i, key := range keys {
+		if i % 2 == 0 {
+			if _, err := btree.Delete([]byte(key)); err != nil { t.Fatal(err) }
+		} else {
+			if err := btree.Insert([]byte(key), bytes.Repeat([]byte{'x'}, 100)); err != nil { t.Fatal(err) }
+		}
+	}
+	assert.Greater(t, btree.gen, gen)
+	assert.Equal(t, gen, btree.oldestReader())
+	checkPageAccounting(t, btree)
+
+	val, found, err := txn.Get([]byte("key00000"))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "valkey00000", string(val))
+
+	crs := txn.Cursor()
+	var got []string
+	for k, v := range crs.Range(nil, nil) {
+		assert.Equal(t, "val" + string(k), string(v))
+		got = append(got, string(k))
+	}
+	crs.Close()
+	assert.NoError(t, crs.Err())
+	assert.Equal(t, keys, got)
+
+	// the latest commit sees the new tree
+	_, found, err = btree.Get([]byte("key00000"))
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	assert.NoError(t, txn.Rollback())
+	assert.NoError(t, txn.Rollback())
+	_, _, err = txn.Get([]byte("key00000"))
+	assert.Equal(t, TxnErrorDone, err)
+
+	// the next commit can reuse everything the snapshot was holding
+	assert.Equal(t, btree.gen, btree.oldestReader())
+	if err := btree.Insert([]byte("another"), nil); err != nil { t.Fatal(err) }
+	assert.Empty(t, btree.pending)
+	checkPageAccounting(t, btree)
+}
+
+func Test_Txn_Read_Many(t *testing.T) {
+	btree := createTestBtree(t, 16)
+
+	// one snapshot per generation
+	var txns []*Txn
+	for i := range 50 {
+		if err := btree.Insert(fmt.Appendf(nil, "key%05d", i), nil); err != nil { t.Fatal(err) }
+		txns = append(txns, btree.BeginRead())
+	}
+	for i := range 50 {
+		if _, err := btree.Delete(fmt.Appendf(nil, "key%05d", i)); err != nil { t.Fatal(err) }
+	}
+
+	for i, txn := range txns {
+		n := 0
+		crs := txn.Cursor()
+		for range crs.Range(nil, nil) { n++ }
+		crs.Close()
+		assert.Equal(t, i+1, n)
+
+		assert.Equal(t, txn.Gen(), btree.oldestReader())
+		txn.Rollback()
+	}
+	checkPageAccounting(t, btree)
+}
+
+func Test_Txn_Write_Commit(t *testing.T) {
+	btree := createTestBtree(t, 64)
+	keys := fillTestBtree(t, btree, 300)
+	gen := btree.gen
+
+	txn := btree.BeginWrite()
+	assert.True(t, txn.Writable())
+	assert.Equal(t, gen+1, txn.Gen())
+	for i := range 300 {
+		key := fmt.Appendf(nil, "new%05d", i)
+		if err := txn.Insert(key, key); err != nil { t.Fatal(err) }
+	}
+	for _, key := range keys[:100] {
+		found, err := txn.Delete([]byte(key))
+		assert.NoError(t, err)
+		assert.True(t, found)
+	}
+
+	// the transaction sees its own writes, nobody else does
+	val, found, err := txn.Get([]byte("new00042"))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "new00042", string(val))
+	_, found, _ = btree.Get([]byte("new00042"))
+	assert.False(t, found)
+	_, found, _ = txn.Get([]byte(keys[0]))
+	assert.False(t, found)
+
+	// every page is copied once at most, and nothing stays pinned between operations
+	ids := make(map[uint64]bool)
+	for _, pageId := range txn.ws.created {
+		assert.False(t, ids[pageId])
+		ids[pageId] = true
+	}
+	assert.Empty(t, txn.ws.frames)
+
+	assert.NoError(t, txn.Commit())
+	assert.Equal(t, TxnErrorDone, txn.Commit())
+	assert.NoError(t, txn.Rollback())
+	assert.Equal(t, TxnErrorDone, txn.Insert([]byte("late"), nil))
+
+	assert.Equal(t, gen+1, btree.gen)
+	pairs, _ := dumpTree(t, btree)
+	assert.Equal(t, 500, len(pairs))
+	_, found, _ = btree.Get([]byte("new00042"))
+	assert.True(t, found)
+	checkPageAccounting(t, btree)
+}
+
+func Test_Txn_Write_Rollback(t *testing.T) {
+	btree := createTestBtree(t, 64)
+	keys := fillTestBtree(t, btree, 300)
+	gen := btree.gen
+	rootId := btree.meta().RootId()
+	nextId := btree.pager.NextId()
+
+	for range 5 {
+		txn := btree.BeginWrite()
+		for i := range 200 {
+			if err := txn.Insert(fmt.Appendf(nil, "new%05d", i), nil); err != nil { t.Fatal(err) }
+		}
+		for _, key := range keys[:50] {
+			if _, err := txn.Delete([]byte(key)); err != nil { t.Fatal(err) }
+		}
+		assert.NoError(t, txn.Rollback())
+		assert.Equal(t, TxnErrorDone, txn.Commit())
+	}
+
+	assert.Equal(t, gen, btree.gen)
+	assert.Equal(t, rootId, btree.meta().RootId())
+	// the copies' pages are handed back, so retrying doesn't grow the file
+	assert.Less(t, btree.pager.NextId(), nextId + 40)
+	checkPageAccounting(t, btree)
+
+	pairs, _ := dumpTree(t, btree)
+	assert.Equal(t, len(keys), len(pairs))
+
+	// and nothing is left behind for the next one
+	if err := btree.Insert([]byte("after"), nil); err != nil { t.Fatal(err) }
+	pairs, _ = dumpTree(t, btree)
+	assert.Equal(t, len(keys)+1, len(pairs))
+	checkPageAccounting(t, btree)
+}
+
+func Test_Txn_Write_Commit_Error(t *testing.T) {
+	// some garbage on it, so commits write a free-list too
+	fp := memfile()
+	pgr, err := pager.CreatePagerWith(memfs.Open, fp, 256)
+	if err != nil { t.Fatal(err) }
+	btree, err := CreateBtree(pgr)
+	if err != nil { t.Fatal(err) }
+	keys := fillTestBtree(t, btree, 300)
+	for _, key := range keys[:100] {
+		if _, err := btree.Delete([]byte(key)); err != nil { t.Fatal(err) }
+	}
+	btree.Close()
+	pgr.Close()
+	raw := bytes.Clone(memfs.File(fp).Bytes())
+
+	// a copy of it, on a backend that fails write or sync number failAt (0 for none) - plenty
+	// of frames, so nothing is written back before the commit
+	open := func(failAt uint64) (*Btree, *system.FaultBackend) {
+		fp := memfile()
+		memfs.WriteFile(fp, raw)
+		var fb *system.FaultBackend
+		plan := system.FaultPlan{ At: map[uint64]system.Fault{ failAt: system.FaultFail } }
+		open := system.FaultOpener(memfs.Open, plan, func(opened *system.FaultBackend) { fb = opened })
+		pgr, err := pager.OpenPagerWith(open, fp, 256)
+		if err != nil { t.Fatal(err) }
+		t.Cleanup(func() { pgr.Close() })
+		btree, err := OpenBtree(pgr)
+		if err != nil { t.Fatal(err) }
+		return btree, fb
+	}
+	commit := func(btree *Btree) error {
+		txn := btree.BeginWrite()
+		for i := range 200 {
+			if err := txn.Insert(fmt.Appendf(nil, "new%05d", i), nil); err != nil { t.Fatal(err) }
+		}
+		for _, key := range keys[100:150] {
+			if _, err := txn.Delete([]byte(key)); err != nil { t.Fatal(err) }
+		}
+		return txn.Commit()
+	}
+
+	// how many writes and syncs a commit takes - the last two are the meta page and its sync
+	btree, fb := open(0)
+	assert.NoError(t, commit(btree))
+	ops := fb.Ops()
+	assert.Greater(t, ops, uint64(3))
+
+	// fail each of the ones before the meta page
+	for failAt := uint64(1); failAt < ops - 1; failAt++ {
+		btree, _ := open(failAt)
+		assert.ErrorIs(t, commit(btree), syscall.EIO, "op %d", failAt)
+		pairs, _ := dumpTree(t, btree)
+		assert.Equal(t, 200, len(pairs))
+		checkPageAccounting(t, btree)
+
+		// nothing of the failed one gets in the way of the next
+		assert.NoError(t, commit(btree))
+		pairs, _ = dumpTree(t, btree)
+		assert.Equal(t, 350, len(pairs))
+		checkPageAccounting(t, btree)
+	}
+}
+
+func Test_Txn_Read_Only(t *testing.T) {
+	btree := createTestBtree(t, 16)
+
+	txn := btree.BeginRead()
+	defer txn.Rollback()
+
+	assert.False(t, txn.Writable())
+	assert.Equal(t, TxnErrorReadOnly, txn.Insert([]byte("k"), nil))
+	_, err := txn.Delete([]byte("k"))
+	assert.Equal(t, TxnErrorReadOnly, err)
+	assert.Equal(t, TxnErrorReadOnly, txn.Commit())
+}
+
+func Test_Txn_Write_Empty(t *testing.T) {
+	btree := createTestBtree(t, 16)
+	gen := btree.gen
+
+	txn := btree.BeginWrite()
+	found, err := txn.Delete([]byte("missing"))
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.NoError(t, txn.Commit())
+	assert.Equal(t, gen, btree.gen)
+}
+
+func Test_Txn_Write_Exclusive(t *testing.T) {
+	btree := createTestBtree(t, 16)
+
+	txn := btree.BeginWrite()
+	_, err := btree.TryBeginWrite()
+	assert.Equal(t, TxnErrorBusy, err)
+
+	// readers don't care
+	read := btree.BeginRead()
+	read.Rollback()
+
+	done := make(chan struct{})
+	go func() {
+		other := btree.BeginWrite()
+		other.Rollback()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("second writer got in")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	txn.Rollback()
+	<-done
+
+	txn, err = btree.TryBeginWrite()
+	assert.NoError(t, err)
+	assert.NoError(t, txn.Commit())
+}
+
+// Best run with -race. The writer keeps rewriting a fixed set of keys to the same value
+// (the round), and keeps a counter key in step with how many extra keys there are. Every
+// reader has to see all of one round and nothing of any other.
+func Test_Txn_Concurrent_Readers(t *testing.T) {
+	btree := createTestBtree(t, 256)
+
+	const KEYS = 200
+	const ROUNDS = 150
+	const READERS = 8
+
+	var stop atomic.Bool
+	var reads atomic.Int64
+	var wg sync.WaitGroup
+	errs := make(chan error, READERS)
+
+	check := func() error {
+		txn := btree.BeginRead()
+		defer txn.Rollback()
+
+		var round string
+		keys, extras := 0, 0
+		count := ""
+		crs := txn.Cursor()
+		defer crs.Close()
+		for k, v := range crs.Range(nil, nil) {
+			// reused pages could have us going in circles
+			if keys+extras > 1000 { return fmt.Errorf("gen %d: too many keys at %s", txn.Gen(), k) }
+			switch {
+			case bytes.HasPrefix(k, []byte("count")):
+				count = string(v)
+			case bytes.HasPrefix(k, []byte("extra")):
+				extras++
+			default:
+				if keys == 0 { round = string(v) }
+				if string(v) != round {
+					return fmt.Errorf("gen %d: %s is %s, expected %s", txn.Gen(), k, v, round)
+				}
+				keys++
+			}
+		}
+		if crs.Err() != nil { return crs.Err() }
+		if keys != KEYS { return fmt.Errorf("gen %d: %d keys", txn.Gen(), keys) }
+		if count != fmt.Sprint(extras) {
+			return fmt.Errorf("gen %d: %d extras, count says %s", txn.Gen(), extras, count)
+		}
+		return nil
+	}
+
+	txn := btree.BeginWrite()
+	for i := range KEYS {
+		if err := txn.Insert(fmt.Appendf(nil, "key%05d", i), []byte("0")); err != nil { t.Fatal(err) }
+	}
+	if err := txn.Insert([]byte("count"), []byte("0")); err != nil { t.Fatal(err) }
+	if err := txn.Commit(); err != nil { t.Fatal(err) }
+
+	for range READERS {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				if err := check(); err != nil {
+					errs <- err
+					return
+				}
+				reads.Add(1)
+				runtime.Gosched()
+			}
+		}()
+	}
+
+	r := rand.New(rand.NewPCG(7, 8))
+	extras := make(map[int]bool)
+	for round := 1; round <= ROUNDS; round++ {
+		txn := btree.BeginWrite()
+		before := maps.Clone(extras)
+		val := fmt.Appendf(nil, "%d", round)
+		for i := range KEYS {
+			if err := txn.Insert(fmt.Appendf(nil, "key%05d", i), val); err != nil { t.Fatal(err) }
+		}
+		for range 20 {
+			n := r.IntN(300)
+			key := fmt.Appendf(nil, "extra%05d", n)
+			if extras[n] {
+				if _, err := txn.Delete(key); err != nil { t.Fatal(err) }
+				delete(extras, n)
+			} else {
+				if err := txn.Insert(key, bytes.Repeat([]byte{'e'}, 100)); err != nil { t.Fatal(err) }
+				extras[n] = true
+			}
+		}
+		if err := txn.Insert([]byte("count"), fmt.Appendf(nil, "%d", len(extras))); err != nil { t.Fatal(err) }
+
+		// now and then change our mind, readers must never see it
+		if r.IntN(8) == 0 {
+			txn.Rollback()
+			extras = before
+			continue
+		}
+		if err := txn.Commit(); err != nil { t.Fatal(err) }
+
+		// make sure the readers get a look in, even on a single core
+		want := reads.Load() + 1
+		for reads.Load() < want && len(errs) == 0 {
+			runtime.Gosched()
+		}
+	}
+
+	stop.Store(true)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	assert.Greater(t, reads.Load(), int64(READERS))
+	checkPageAccounting(t, btree)
+}
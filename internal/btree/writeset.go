@@ -0,0 +1,435 @@
+package btree
+
+import (
+	c "mooodb/internal"
+	"bytes"
+	"context"
+	"mooodb/internal/btree/page"
+	"mooodb/internal/pager"
+)
+
+// The pages created by a write transaction, all stamped with the same generation.
+//
+// Pages of our own generation have never been seen by anyone else, so once a page has been
+// copied into the set, later writes in the same transaction change it in place. Pages are
+// only pinned while an insert or delete is working on them - after that they're marked
+// dirty and left to the pager, which writes them back when it needs the frame or on commit.
+type writeSet struct {
+	btree 	*Btree
+	ctx 	context.Context // for waiting on frames
+	gen 	uint64
+	frames 	[]*pager.Frame // pinned by the current operation
+	pinned 	map[uint64]*pager.Frame // frames by page id
+	owned 	map[uint64]bool // pages of our generation still in the tree
+	created []uint64 // every page we took from the pager
+	retired []uint64 // pages this write drops from the tree
+}
+
+func newWriteSet(ctx context.Context, btree *Btree, gen uint64) *writeSet {
+	return &writeSet{
+		btree: 	btree,
+		ctx: 	ctx,
+		gen: 	gen,
+		pinned: make(map[uint64]*pager.Frame),
+		owned: 	make(map[uint64]bool),
+	}
+}
+
+// Result of splitting a page - the new right sibling and the lowest key that routes to it
+type split struct {
+	key 	[]byte
+	pageId 	uint64
+}
+
+// A key/val pair lifted off a page that is about to be rebuilt
+type entry struct {
+	key 	[]byte
+	val 	[]byte
+}
+
+// Fresh empty page
+func (ws *writeSet) create(leaf bool, parent uint64) (page.PageSlotted, error) {
+	frame, err := ws.btree.pager.CreatePageCtx(ws.ctx)
+	if err != nil { return page.PageSlotted{}, err }
+	ws.pin(frame)
+	ws.owned[frame.PageId()] = true
+	ws.created = append(ws.created, frame.PageId())
+
+	return page.PageSlottedNew(frame.BufferHandle(), frame.PageId(), leaf, ws.gen, parent), nil
+}
+
+// Copies an existing page into a fresh page of this generation. Pages that already are of
+// this generation are handed back as they are.
+func (ws *writeSet) cow(pageId uint64, parent uint64) (page.PageSlotted, error) {
+	frame, err := ws.own(pageId)
+	if err != nil { return page.PageSlotted{}, err }
+	if frame != nil {
+		pg := page.PageSlottedFrom(frame.BufferHandle())
+		pg.SetParent(parent)
+		return pg, nil
+	}
+
+	old, err := ws.btree.pager.GetPageCtx(ws.ctx, pageId)
+	if err != nil { return page.PageSlotted{}, err }
+	defer old.Release()
+	if err := old.Wait(); err != nil { return page.PageSlotted{}, err }
+
+	frame, err = ws.btree.pager.CreatePageCtx(ws.ctx)
+	if err != nil { return page.PageSlotted{}, err }
+	ws.pin(frame)
+	ws.owned[frame.PageId()] = true
+	ws.created = append(ws.created, frame.PageId())
+
+	copy(frame.BufferHandle(), old.BufferHandle())
+	pg := page.PageSlottedFrom(frame.BufferHandle())
+	pg.SetId(frame.PageId())
+	pg.SetGen(ws.gen)
+	pg.SetParent(parent)
+	ws.retired = append(ws.retired, pageId)
+
+	return pg, nil
+}
+
+// Copies a page into dst without keeping it pinned
+func (ws *writeSet) read(pageId uint64, dst []byte) error {
+	frame, err := ws.btree.pager.GetPageCtx(ws.ctx, pageId)
+	if err != nil { return err }
+	defer frame.Release()
+	if err := frame.Wait(); err != nil { return err }
+
+	copy(dst, frame.BufferHandle())
+	return nil
+}
+
+// Frame of a page of our generation, pinned for the rest of the operation. nil if it isn't
+// one of ours.
+func (ws *writeSet) own(pageId uint64) (*pager.Frame, error) {
+	if !ws.owned[pageId] { return nil, nil }
+	if frame, found := ws.pinned[pageId]; found { return frame, nil }
+
+	frame, err := ws.btree.pager.GetPageCtx(ws.ctx, pageId)
+	if err != nil { return nil, err }
+	ws.pin(frame)
+	if err := frame.Wait(); err != nil { return nil, err }
+	return frame, nil
+}
+
+func (ws *writeSet) pin(frame *pager.Frame) {
+	ws.frames = append(ws.frames, frame)
+	ws.pinned[frame.PageId()] = frame
+}
+
+// Drops a page from the tree. If it is one of our own nobody has ever seen it, so it is
+// turned into a free page in place.
+func (ws *writeSet) free(pageId uint64) error {
+	frame, err := ws.own(pageId)
+	if err != nil { return err }
+	if frame != nil {
+		page.PageFreeNew(frame.BufferHandle(), pageId, ws.gen)
+		delete(ws.owned, pageId)
+	}
+	ws.retired = append(ws.retired, pageId)
+	return nil
+}
+
+// Ends an operation - every page it pinned gets checksummed (any page type, the checksum
+// lives in the common header), marked dirty and unpinned.
+func (ws *writeSet) done() {
+	for _, frame := range ws.frames {
+		pg := page.PageSlottedFrom(frame.BufferHandle())
+		pg.DoChecksum()
+		frame.MarkDirty(ws.gen)
+		frame.Release()
+	}
+	ws.frames = ws.frames[:0]
+	clear(ws.pinned)
+}
+
+// Unpins anything the current operation was holding without keeping its changes, and
+// returns the ids of every page we took
+func (ws *writeSet) release() []uint64 {
+	for _, frame := range ws.frames {
+		frame.Release()
+	}
+	ws.frames = nil
+	clear(ws.pinned)
+	clear(ws.owned)
+
+	ids := ws.created
+	ws.created = nil
+	return ids
+}
+
+// Throws away every page we took, written or not, and hands their ids back to the pager
+func (ws *writeSet) discard() {
+	ids := ws.release()
+	ws.btree.pager.Discard(ids...)
+	ws.btree.pager.Reuse(ids...)
+}
+
+// Copies the path down to key's leaf. Returns the copies from the root down (the leaf is
+// last), along with the slot each inner page routed through.
+func (ws *writeSet) cowPath(rootId uint64, key []byte) ([]page.PageSlotted, []int, error) {
+	path := make([]page.PageSlotted, 0, CURSOR_STACK_DEPTH)
+	slots := make([]int, 0, CURSOR_STACK_DEPTH)
+
+	pg, err := ws.cow(rootId, ROOT_PARENT)
+	if err != nil { return nil, nil, err }
+
+	for pg.IsTypeInner() {
+		if len(path) == CURSOR_STACK_DEPTH-1 { return nil, nil, BtreeErrorCorrupt }
+		childIdVal, slot := pg.GetLargestLessEq(key)
+		if slot < 0 { return nil, nil, BtreeErrorCorrupt }
+
+		child, err := ws.cow(c.Bin.Uint64(childIdVal), pg.Id())
+		if err != nil { return nil, nil, err }
+		// repoint the (already copied) parent at the copy
+		c.Bin.PutUint64(childIdVal, child.Id())
+
+		path = append(path, pg)
+		slots = append(slots, slot)
+		pg = child
+	}
+	if !pg.IsTypeLeaf() { return nil, nil, BtreeErrorCorrupt }
+
+	return append(path, pg), slots, nil
+}
+
+// Copies the path down to key's leaf, puts into the leaf, and splits back up as far as
+// needed. Returns the id of the new root.
+func (ws *writeSet) insert(rootId uint64, key []byte, val []byte) (uint64, error) {
+	path, _, err := ws.cowPath(rootId, key)
+	if err != nil { return 0, err }
+
+	leaf := len(path) - 1
+	spl, err := ws.put(&path[leaf], key, val)
+	if err != nil { return 0, err }
+
+	childIdVal := make([]byte, c.LEN_U64)
+	for i := leaf - 1; i >= 0 && spl != nil; i-- {
+		c.Bin.PutUint64(childIdVal, spl.pageId)
+		spl, err = ws.put(&path[i], spl.key, childIdVal)
+		if err != nil { return 0, err }
+	}
+
+	if spl != nil {
+		return ws.grow(path[0].Id(), spl)
+	}
+	return path[0].Id(), nil
+}
+
+// Copies the path down to key's leaf and deletes from the leaf. Underfull pages are
+// rebalanced with a sibling on the way back up. Returns the id of the new root.
+func (ws *writeSet) delete(rootId uint64, key []byte) (uint64, error) {
+	path, slots, err := ws.cowPath(rootId, key)
+	if err != nil { return 0, err }
+
+	pg := path[len(path)-1]
+	pg.Delete(key)
+
+	var spl *split
+	childIdVal := make([]byte, c.LEN_U64)
+	for i := len(path) - 2; i >= 0; i-- {
+		parent := &path[i]
+		if spl != nil {
+			// rebalancing below changed a separator and the parent ran out of room
+			c.Bin.PutUint64(childIdVal, spl.pageId)
+			spl, err = ws.put(parent, spl.key, childIdVal)
+		} else if underfull(&pg) {
+			spl, err = ws.rebalance(parent, slots[i], &pg)
+		}
+		if err != nil { return 0, err }
+		pg = *parent
+	}
+
+	if spl != nil {
+		return ws.grow(pg.Id(), spl)
+	}
+
+	// a root with a single child is just a longer path to that child - the only child left
+	// is always the copy we came down through
+	for pg.IsTypeInner() && pg.EntryCount() == 1 {
+		frame, err := ws.own(c.Bin.Uint64(pg.ValAt(0)))
+		if err != nil { return 0, err }
+		if frame == nil { break }
+
+		if err := ws.free(pg.Id()); err != nil { return 0, err }
+		pg = page.PageSlottedFrom(frame.BufferHandle())
+		pg.SetParent(ROOT_PARENT)
+	}
+
+	return pg.Id(), nil
+}
+
+// The root split, so the tree grows a level. Returns the id of the new root.
+func (ws *writeSet) grow(leftId uint64, spl *split) (uint64, error) {
+	root, err := ws.create(false, ROOT_PARENT)
+	if err != nil { return 0, err }
+
+	childIdVal := make([]byte, c.LEN_U64)
+	c.Bin.PutUint64(childIdVal, leftId)
+	root.Put([]byte{}, childIdVal)
+	c.Bin.PutUint64(childIdVal, spl.pageId)
+	root.Put(spl.key, childIdVal)
+
+	return root.Id(), nil
+}
+
+// Puts into a page of this generation, defragmenting and then splitting if it doesn't fit.
+func (ws *writeSet) put(pg *page.PageSlotted, key []byte, val []byte) (*split, error) {
+	if _, ok := pg.Put(key, val); ok { return nil, nil }
+
+	pg.Defragment(ws.btree.scratch)
+	if _, ok := pg.Put(key, val); ok { return nil, nil }
+
+	return ws.split(pg, key, val)
+}
+
+// Splits a page roughly in half by bytes, with the new entry merged in. The left half
+// stays in pg, the right half goes to a fresh page.
+//
+// Separators are copied up, not moved - the first key of the right page is also the key
+// its parent routes by.
+func (ws *writeSet) split(pg *page.PageSlotted, key []byte, val []byte) (*split, error) {
+	scratch := ws.btree.scratch[:c.PAGE_SIZE]
+	copy(scratch, pg.Raw())
+	src := page.PageSlottedFrom(scratch)
+
+	entries := make([]entry, 0, src.EntryCount()+1)
+	placed := false
+	for i := range src.EntryCount() {
+		k := src.KeyAt(i)
+		if !placed {
+			cmp := bytes.Compare(key, k)
+			if cmp <= 0 {
+				entries = append(entries, entry{key, val})
+				placed = true
+				if cmp == 0 { continue } // overwrite
+			}
+		}
+		entries = append(entries, entry{k, src.ValAt(i)})
+	}
+	if !placed {
+		entries = append(entries, entry{key, val})
+	}
+
+	right, err := ws.create(src.IsTypeLeaf(), src.Parent())
+	if err != nil { return nil, err }
+
+	mid := splitPoint(entries)
+	if err := ws.rebuild(pg, entries[:mid]); err != nil { return nil, err }
+	if err := ws.rebuild(&right, entries[mid:]); err != nil { return nil, err }
+
+	// scratch gets reused further up the tree
+	return &split{ key: bytes.Clone(entries[mid].key), pageId: right.Id() }, nil
+}
+
+// Merges an underfull child with one of its siblings if they fit in one page, otherwise
+// evens the two out. The child (and parent) must already be copies of this generation.
+//
+// The merged page is always the child, so the sibling is just left behind in the older
+// generation. Redistributing changes the sibling's separator in the parent, which might
+// not fit - that split is returned for the grandparent.
+func (ws *writeSet) rebalance(parent *page.PageSlotted, slot int, child *page.PageSlotted) (*split, error) {
+	n := int(parent.EntryCount())
+	if n < 2 { return nil, nil }
+
+	sibSlot := slot + 1
+	if sibSlot == n { sibSlot = slot - 1 }
+	leftSlot := uint16(min(slot, sibSlot))
+	sibId := c.Bin.Uint64(parent.ValAt(uint16(sibSlot)))
+
+	// lift both pages into scratch, so either can be rebuilt from the entries
+	childSrc := page.PageSlottedFrom(ws.btree.scratch[:c.PAGE_SIZE])
+	sibSrc := page.PageSlottedFrom(ws.btree.scratch[c.PAGE_SIZE:])
+	copy(childSrc.Raw(), child.Raw())
+	if err := ws.read(sibId, sibSrc.Raw()); err != nil { return nil, err }
+	if sibSrc.Pagetype() != child.Pagetype() { return nil, BtreeErrorCorrupt }
+
+	var entries []entry
+	if slot < sibSlot {
+		entries = collect(&childSrc, entries)
+		entries = collect(&sibSrc, entries)
+	} else {
+		entries = collect(&sibSrc, entries)
+		entries = collect(&childSrc, entries)
+	}
+
+	total := 0
+	for _, e := range entries {
+		total += entrySize(e.key, e.val)
+	}
+
+	if total <= int(page.SlottedCapacity) {
+		if err := ws.rebuild(child, entries); err != nil { return nil, err }
+		c.Bin.PutUint64(parent.ValAt(leftSlot), child.Id())
+		parent.Delete(bytes.Clone(parent.KeyAt(leftSlot + 1)))
+		return nil, ws.free(sibId)
+	}
+
+	sib, err := ws.cow(sibId, parent.Id())
+	if err != nil { return nil, err }
+
+	left, right := child, &sib
+	if sibSlot < slot {
+		left, right = right, left
+	}
+
+	mid := splitPoint(entries)
+	if err := ws.rebuild(left, entries[:mid]); err != nil { return nil, err }
+	if err := ws.rebuild(right, entries[mid:]); err != nil { return nil, err }
+
+	c.Bin.PutUint64(parent.ValAt(leftSlot), left.Id())
+	parent.Delete(bytes.Clone(parent.KeyAt(leftSlot + 1)))
+
+	// scratch gets reused if the parent has to split
+	sepKey := bytes.Clone(entries[mid].key)
+	childIdVal := make([]byte, c.LEN_U64)
+	c.Bin.PutUint64(childIdVal, right.Id())
+
+	return ws.put(parent, sepKey, childIdVal)
+}
+
+// Wipes pg and fills it with entries, which must be sorted, must fit, and must not point
+// into pg itself.
+func (ws *writeSet) rebuild(pg *page.PageSlotted, entries []entry) error {
+	*pg = page.PageSlottedNew(pg.Raw(), pg.Id(), pg.IsTypeLeaf(), ws.gen, pg.Parent())
+	for _, e := range entries {
+		if _, ok := pg.Put(e.key, e.val); !ok { return BtreeErrorCorrupt }
+	}
+	return nil
+}
+
+// Appends every entry on the page, in key order
+func collect(pg *page.PageSlotted, entries []entry) []entry {
+	for i := range pg.EntryCount() {
+		entries = append(entries, entry{pg.KeyAt(i), pg.ValAt(i)})
+	}
+	return entries
+}
+
+// Index to split entries at so both sides end up with about the same number of bytes.
+// Both sides always get at least one entry.
+func splitPoint(entries []entry) int {
+	total := 0
+	for _, e := range entries {
+		total += entrySize(e.key, e.val)
+	}
+
+	mid, acc := 0, 0
+	for mid < len(entries)-1 && acc+entrySize(entries[mid].key, entries[mid].val) <= total/2 {
+		acc += entrySize(entries[mid].key, entries[mid].val)
+		mid++
+	}
+	return max(mid, 1)
+}
+
+// Less than a quarter full
+func underfull(pg *page.PageSlotted) bool {
+	return pg.UsedBytes() < page.SlottedCapacity/4
+}
+
+// Bytes an entry takes up on a page, including its slot
+func entrySize(key []byte, val []byte) int {
+	return c.LEN_U16 + len(key) + c.LEN_U16 + len(val) + c.LEN_U16
+}
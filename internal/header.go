@@ -0,0 +1,15 @@
+package internal
+
+import (
+	"github.com/cespare/xxhash"
+)
+
+// Every page starts with the same header (see btree/page). The pager only needs to know
+// where the checksum and the page id sit in it, to check pages as they come off the disk.
+const PAGE_OFF_CHECKSUM	= 0x00 // 8B, over everything after it
+const PAGE_OFF_ID 		= 0x08 // 8B
+
+// What the checksum of the page in raw should be
+func PageChecksum(raw []byte) uint64 {
+	return xxhash.Sum64(raw[PAGE_OFF_CHECKSUM + LEN_U64:PAGE_SIZE])
+}
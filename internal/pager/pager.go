@@ -5,32 +5,179 @@ import (
 	system "mooodb/internal/system"
 	"sync/atomic"
 
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"slices"
 	"sync"
+	"syscall"
+
+	"github.com/cespare/xxhash"
 )
 
+// Most dirty frames written back at once when eviction runs into them
+const WRITEBACK_BATCH = 16
+
+// Most pages (next to each other in the file) written back with a single writev
+const WRITEBACK_RUN_MAX = 64
+
+// The page table is split into shards by page id hash, each with its own lock and its own
+// share of the frames, so GetPage on different pages doesn't serialize on one mutex. A page
+// only ever lives in its own shard's frames, which keeps everything about a frame under a
+// single lock - the price is that a shard can run out of frames while others have some to
+// spare, so small pools don't get sharded at all.
+const SHARD_MAX 		= 64
+const SHARD_MIN_FRAMES 	= 64 // fewest frames a shard is given
+
 type Pager struct {
 	rawBuf 		[]byte
 
 	frames 		[]Frame
-	// PERF: it will be very easy to shard this in the future
-	frameMap	map[uint64]int
-	frameMapMu	sync.Mutex
+	shards 		[]shard
+	shardMask 	uint64
 
-	freeFrames  chan int
+	waiters 	atomic.Int32 // callers waiting for a frame in GetPageCtx/CreatePageCtx
+	waitMu 		sync.Mutex
+	frameWait 	chan struct{} // closed when a frame might have freed up - guarded by waitMu
 
+	// page ids - idMu is taken before any shard lock, never after
+	idMu 		sync.Mutex
 	nextId 		uint64
-	iomgr		*system.IoMgr
+	reusable 	[]uint64 // ids handed back with Reuse
+
+	io 			system.IoBackend
 
 	diskOp		system.DiskOp // for fsync, truncate, etc
 }
 
-func pagerErr(errno int) error {
-	// TODO: proper
-	return fmt.Errorf("pager error: %d", errno)
+// One slice of the page table. The frames in it, and everything about them that isn't
+// atomic, are guarded by mu.
+type shard struct {
+	mu 			sync.Mutex
+	frameMap 	map[uint64]int
+	frames 		[]int // indexes of the frames that belong to this shard
+	freeFrames 	[]int // of those, the ones that have never held a page (or were discarded)
+	clockHand 	int // next entry in frames the CLOCK sweep looks at
+
+	_ [64]byte // keep neighbouring shard locks off each other's cache lines
+}
+// Already-closed channel, for frames that have no disk op to wait on
+var doneCh = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// Every frame (in the page's shard) is pinned, so there's nowhere to put the page until one
+// is released
+var errNoFrame = errors.New("pager: no free frame")
+
+// The backend broke down as a whole (ie. its io_uring died), not just one op. Nothing is
+// going to be read or written anymore - the database has to be closed and reopened. Shows up
+// wrapped in an *IOError, so check for it with errors.Is.
+var ErrIOFailed = errors.New("pager: I/O backend failed")
+
+// A disk op the pager submitted came back with an error. Err is the syscall.Errno from the
+// op's result, so errors.Is(err, syscall.EIO) and friends work - or if the backend itself
+// failed, ErrIOFailed wrapping why.
+type IOError struct {
+	Op 		system.OpCode
+	PageId 	uint64 // meaningless for OpSync
+	Err 	error
+}
+
+func (e *IOError) Error() string {
+	switch e.Op {
+	case system.OpRead:
+		return fmt.Sprintf("pager: read page %d: %v", e.PageId, e.Err)
+	case system.OpWrite:
+		return fmt.Sprintf("pager: write page %d: %v", e.PageId, e.Err)
+	case system.OpSync:
+		return fmt.Sprintf("pager: sync: %v", e.Err)
+	}
+	return fmt.Sprintf("pager: op %d page %d: %v", e.Op, e.PageId, e.Err)
+}
+
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
+
+// A page came back from disk, but not the way it was written - its checksum doesn't match
+// (a torn write, or bits flipped at rest), or it belongs to a different page id altogether
+// (a misdirected read or write). Expected is the checksum stored on the page, Actual what
+// its contents hash to.
+type ErrPageCorrupt struct {
+	PageId 		uint64
+	Expected 	uint64
+	Actual 		uint64
+	StoredId 	uint64 // the id on the page, if it isn't PageId we read someone else's page
+}
+
+func (e *ErrPageCorrupt) Error() string {
+	if e.StoredId != e.PageId {
+		return fmt.Sprintf("pager: page %d is corrupt: holds page %d", e.PageId, e.StoredId)
+	}
+	return fmt.Sprintf("pager: page %d is corrupt: checksum %016x, expected %016x",
+		e.PageId, e.Actual, e.Expected)
+}
+
+// Checks a freshly read page against the id it was read from. Every page is checksummed
+// (over the common header too) before it is written, see internal.PageChecksum.
+func verifyPage(pageId uint64, raw []byte) error {
+	expected, actual := c.Bin.Uint64(raw[c.PAGE_OFF_CHECKSUM:]), c.PageChecksum(raw)
+	storedId := c.Bin.Uint64(raw[c.PAGE_OFF_ID:])
+	if expected != actual || storedId != pageId {
+		return &ErrPageCorrupt{
+			PageId: 	pageId,
+			Expected: 	expected,
+			Actual: 	actual,
+			StoredId: 	storedId,
+		}
+	}
+	return nil
+}
+
+// nil unless res (a DiskOp.Res) is negative, ie. -errno
+func (pgr *Pager) ioErr(op system.OpCode, pageId uint64, res int32) error {
+	if res >= 0 { return nil }
+	var err error = syscall.Errno(-res)
+	if failure := pgr.io.Err(); failure != nil {
+		err = fmt.Errorf("%w: %w", ErrIOFailed, failure)
+	}
+	return &IOError{ Op: op, PageId: pageId, Err: err }
 }
 
+// For a new database - page ids are handed out starting from 1, so whatever was in the file
+// before will get overwritten. Page 0 is left for callers to use with CreatePageAt.
 func CreatePager(filepath string, pageCnt int) (*Pager, error) {
+	return CreatePagerWith(system.OpenDefault, filepath, pageCnt)
+}
+
+// For an existing database file. New page ids start after the end of the file, callers that
+// know better (ie. from their meta page) should use SetNextId.
+func OpenPager(filepath string, pageCnt int) (*Pager, error) {
+	return OpenPagerWith(system.OpenDefault, filepath, pageCnt)
+}
+
+// Like CreatePager, but with the I/O backend open gives us rather than the default one
+func CreatePagerWith(open system.Opener, filepath string, pageCnt int) (*Pager, error) {
+	return createPager(open, filepath, true, pageCnt, shardCount(pageCnt))
+}
+
+// Like OpenPager, but with the I/O backend open gives us rather than the default one
+func OpenPagerWith(open system.Opener, filepath string, pageCnt int) (*Pager, error) {
+	return createPager(open, filepath, false, pageCnt, shardCount(pageCnt))
+}
+
+func shardCount(pageCnt int) int {
+	// both powers of two, so this is too
+	return min(max(pageCnt / SHARD_MIN_FRAMES, 1), SHARD_MAX)
+}
+
+// shardCnt must be a power of two no bigger than pageCnt
+func createPager(open system.Opener, filepath string, create bool, pageCnt int, shardCnt int) (*Pager, error) {
 	isPowerOfTwo := (pageCnt > 0) && ((pageCnt & (pageCnt - 1)) == 0);
 	if !isPowerOfTwo {
 		return nil, fmt.Errorf("Invalid page count, must be power of two")
@@ -39,124 +186,572 @@ func CreatePager(filepath string, pageCnt int) (*Pager, error) {
 	slab, err := system.AllocAlignedSlab(c.PAGE_SIZE * pageCnt)
 	if err != nil { return nil, err }
 
-	iomgr, err := system.CreateIoMgr(filepath)
-	if err != nil { return nil, err }
+	backend, err := open(filepath, create, slab)
+	if err != nil {
+		system.DeallocAlignedSlab(slab)
+		return nil, err
+	}
+
+	nextId := uint64(1)
+	if !create {
+		size, err := backend.Size()
+		if err != nil {
+			backend.Close()
+			system.DeallocAlignedSlab(slab)
+			return nil, err
+		}
+		nextId = max(size / c.PAGE_SIZE, 1)
+	}
 
 	pager := Pager {
 		rawBuf: slab,
 
-		frameMap: make(map[uint64]int),
-		frameMapMu: sync.Mutex{},
+		shards: make([]shard, shardCnt),
+		shardMask: uint64(shardCnt - 1),
 
-		nextId: 1,
-		iomgr: iomgr,
+		nextId: nextId,
+		io: backend,
 
 		diskOp: system.DiskOp{},
 	}
 
+	for i := range pager.shards {
+		pager.shards[i].frameMap = make(map[uint64]int)
+	}
+
 	frames := make([]Frame, pageCnt)
-	freeFrames := make(chan int, pageCnt)
 	for i := range frames {
 		frames[i].init(i, slab[c.PAGE_SIZE * i: c.PAGE_SIZE * (i + 1)])
 		frames[i].pager = &pager
-		freeFrames <- i
+
+		shard := &pager.shards[i % shardCnt]
+		frames[i].shard = shard
+		shard.frames = append(shard.frames, i)
+		shard.freeFrames = append(shard.freeFrames, i)
 	}
 
 	pager.frames = frames
-	pager.freeFrames = freeFrames
 
 	return &pager, nil
 }
 
+// Writes back every dirty page and syncs, then closes the backend (which waits out anything
+// still in flight, ie. prefetches) and frees the buffers. Those go either way - the error is
+// the first thing that went wrong.
 func (pgr *Pager) Close() error {
-	pgr.iomgr.Close()
-	return system.DeallocAlignedSlab(pgr.rawBuf)
+	err := pgr.Flush(math.MaxUint64)
+	if err == nil { err = pgr.Sync() }
+	pgr.io.Close()
+	if deallocErr := system.DeallocAlignedSlab(pgr.rawBuf); err == nil { err = deallocErr }
+	return err
 }
 
-// nonblocking, returns nil if none are free
-func (pgr *Pager) getFreeFrame() (int, bool) {
-	// TODO: this is responsible for removing a value from the framemap as well
-	// we dont have to do any locking because this is only called with a lock
-	select {
-	case freeIndex := <- pgr.freeFrames:
-		return freeIndex, true
-	default:
-		return -1, false
+// Shard a page id belongs to
+func (pgr *Pager) shardOf(pageId uint64) *shard {
+	var buf [c.LEN_U64]byte
+	c.Bin.PutUint64(buf[:], pageId)
+	return &pgr.shards[xxhash.Sum64(buf[:]) & pgr.shardMask]
+}
+
+// nonblocking, returns -1 if every frame in the shard is pinned (or dirty)
+//
+// Released frames stay in the framemap (so they act as a cache) until they are evicted
+// here. Frames that have never been used go first, after that the CLOCK hand sweeps around
+// for an unpinned frame that hasn't been hit since the hand last passed it - each frame it
+// passes that has been hit gets a second chance. Pages start out without one, so a scan
+// that touches each page once only pushes out other pages nobody is coming back to. Two full
+// turns without finding one means everything is pinned.
+//
+// Dirty frames can't be evicted until they've been written back. If they're all we find,
+// (some of) them are returned instead - it's up to the caller whether to beginWrite them.
+// we dont have to do any locking because this is only called with the shard's lock
+func (pgr *Pager) getFreeFrame(shard *shard) (int, []*Frame) {
+	if n := len(shard.freeFrames); n > 0 {
+		freeIndex := shard.freeFrames[n-1]
+		shard.freeFrames = shard.freeFrames[:n-1]
+		return freeIndex, nil
+	}
+
+	var dirty []*Frame
+	for range 2 * len(shard.frames) {
+		index := shard.frames[shard.clockHand]
+		shard.clockHand = (shard.clockHand + 1) % len(shard.frames)
+
+		frame := &pgr.frames[index]
+		if frame.pins.Load() > 0 || frame.reading() {
+			continue
+		}
+		if frame.ref {
+			frame.ref = false
+			continue
+		}
+		if frame.dirty {
+			if len(dirty) < WRITEBACK_BATCH && !slices.Contains(dirty, frame) {
+				dirty = append(dirty, frame)
+			}
+			continue
+		}
+
+		// evict
+		if mapped, found := shard.frameMap[frame.pageId]; found && mapped == index {
+			delete(shard.frameMap, frame.pageId)
+		}
+		return index, nil
+	}
+	return -1, dirty
+}
+
+// Like getFreeFrame, but writes back dirty frames (and tries again) if that is what it takes.
+// Called with the shard's lock held, but drops it while writing - anything looked up before
+// has to be looked up again.
+//
+// errNoFrame if everything is pinned, or the write-back's error if that failed - there's no
+// point waiting on that, it would only be tried again (and fail again).
+func (pgr *Pager) claimFrame(shard *shard) (int, error) {
+	for {
+		index, dirty := pgr.getFreeFrame(shard)
+		if index >= 0 { return index, nil }
+		if len(dirty) == 0 { return -1, errNoFrame }
+
+		for _, frame := range dirty {
+			pgr.beginWrite(frame)
+		}
+		shard.mu.Unlock()
+		err := pgr.writeBack(dirty)
+		shard.mu.Lock()
+		if err != nil { return -1, err }
 	}
 }
 
 // Returning nil means we didn't have any free frames to load the page into (and the page 
 // wasnt already paged in of course)
 func (pgr *Pager) GetPage(pageId uint64) *Frame {
-	pgr.frameMapMu.Lock()
+	frame, _ := pgr.getPage(pageId)
+	return frame
+}
+
+// GetPage, with why it didn't get a frame
+func (pgr *Pager) getPage(pageId uint64) (*Frame, error) {
+	shard := pgr.shardOf(pageId)
+	shard.mu.Lock()
 
-	index, found := pgr.frameMap[pageId]
+	index, found := shard.frameMap[pageId]
 
 	if found {
 		frame := &pgr.frames[index]
 		frame.pins.Add(1)
-		pgr.frameMapMu.Unlock()
-		return frame
+		frame.ref = true
+		shard.mu.Unlock()
+		return frame, nil
 	} else {
-		frameIndex, foundFreeFrame := pgr.getFreeFrame()
+		frameIndex, err := pgr.claimFrame(shard)
 
-		if !foundFreeFrame {
-			pgr.frameMapMu.Unlock()
-			return nil
-		} else {
-			// we have to initialize a new frame and send a DiskOp request
-			pgr.frameMap[pageId] = frameIndex
-			frame := &pgr.frames[frameIndex]
-			frame.pins.Add(1)
-			frame.diskOp.PrepareOpSlice(system.OpRead, frame.data, c.PageIdToOffset(pageId))
-			frame.pageId = pageId
+		if err != nil {
+			shard.mu.Unlock()
+			return nil, err
+		}
+
+		// someone else might have loaded it while we were writing back
+		if _, found := shard.frameMap[pageId]; found {
+			shard.freeFrames = append(shard.freeFrames, frameIndex)
+			shard.mu.Unlock()
+			return pgr.getPage(pageId)
+		}
+
+		// we have to initialize a new frame and send a DiskOp request
+		frame := pgr.beginRead(shard, frameIndex, pageId)
+		frame.pins.Add(1)
+
+		// Once we have incremented pin and made the Op channel we can safely release
+		//
+		// It is not safe to unlock until we've made the channel, because it will be
+		// a race if some other thread goes to wait on the channel before we initialize it
+		shard.mu.Unlock()
+
+		pgr.io.Submit(&frame.diskOp)
+
+		return frame, nil
+	}
+}
+
+// Must be called with the shard's lock held. Maps pageId to a claimed frame and prepares
+// the read into it - submitting it is up to the caller, once the lock is dropped.
+func (pgr *Pager) beginRead(shard *shard, frameIndex int, pageId uint64) *Frame {
+	shard.frameMap[pageId] = frameIndex
+	frame := &pgr.frames[frameIndex]
+	frame.ref = false
+	frame.dirty = false
+	frame.gen = 0
+	frame.err = nil
+	frame.state.Store(frameLoading)
+	frame.diskOp.PrepareOpSlice(system.OpRead, frame.data, c.PageIdToOffset(pageId))
+	frame.pageId = pageId
+	return frame
+}
+
+// Starts reading pages in, so a GetPage for them later finds them already loaded (or at least
+// on their way). Nothing is pinned for the caller, and it's only a hint - pages that are
+// already resident, or that there is no frame to spare for right now, are skipped. Doesn't
+// wait for anything - a shard with only dirty frames to spare is skipped too, writing them
+// back is left to whoever really needs the frame (and can be told if that fails).
+//
+// A failed read isn't reported here, whoever GetPages the page next gets the error from Wait.
+func (pgr *Pager) Prefetch(ids ...uint64) {
+	var batch []*Frame
+	for _, pageId := range ids {
+		shard := pgr.shardOf(pageId)
+		shard.mu.Lock()
+		if _, found := shard.frameMap[pageId]; found {
+			shard.mu.Unlock()
+			continue
+		}
+
+		frameIndex, _ := pgr.getFreeFrame(shard)
+		if frameIndex < 0 {
+			shard.mu.Unlock()
+			continue
+		}
+
+		batch = append(batch, pgr.beginRead(shard, frameIndex, pageId))
+		shard.mu.Unlock()
+	}
+
+	for _, frame := range batch {
+		pgr.io.Submit(&frame.diskOp)
+	}
+}
+
+// Like GetPage, but if every frame is pinned it waits for one to be released (or written
+// back) instead of returning nil. Gives up with the context's error, or with the error
+// from writing back a dirty frame to make room (ie. ErrIOFailed once the backend is gone).
+func (pgr *Pager) GetPageCtx(ctx context.Context, pageId uint64) (*Frame, error) {
+	return pgr.waitForFrame(ctx, func() (*Frame, error) { return pgr.getPage(pageId) })
+}
 
-			// Once we have incremented pin and made the Op channel we can safely release
-			//
-			// It is not safe to unlock until we've made the channel, because it will be
-			// a race if some other thread goes to wait on the channel before we initialize it
-			pgr.frameMapMu.Unlock()
+// Like CreatePage, but waits for a frame like GetPageCtx does.
+func (pgr *Pager) CreatePageCtx(ctx context.Context) (*Frame, error) {
+	return pgr.waitForFrame(ctx, pgr.createNextPage)
+}
+
+// Keeps trying until get finds a frame, sleeping in between until a frame gets unpinned.
+// Anything but errNoFrame is given up on straight away.
+//
+// We count ourselves as a waiter and grab the wait channel before trying, so a Release that
+// lands after our try is sure to see us and close the channel we're about to sleep on. One
+// that lands before it left a frame for the try to find.
+func (pgr *Pager) waitForFrame(ctx context.Context, get func() (*Frame, error)) (*Frame, error) {
+	pgr.waiters.Add(1)
+	defer pgr.waiters.Add(-1)
+
+	for {
+		if err := ctx.Err(); err != nil { return nil, err }
+
+		pgr.waitMu.Lock()
+		if pgr.frameWait == nil {
+			pgr.frameWait = make(chan struct{})
+		}
+		wait := pgr.frameWait
+		pgr.waitMu.Unlock()
 
-			pgr.iomgr.OpQueue <- &frame.diskOp
+		frame, err := get()
+		if err == nil { return frame, nil }
+		if err != errNoFrame { return nil, err }
 
-			return frame
+		select {
+		case <- wait:
+		case <- ctx.Done():
+			return nil, ctx.Err()
 		}
 	}
 }
 
-// For new pages that don't exist yet
+// Lets anyone in waitForFrame have another go
+func (pgr *Pager) wakeWaiters() {
+	if pgr.waiters.Load() == 0 { return }
+
+	pgr.waitMu.Lock()
+	if pgr.frameWait != nil {
+		close(pgr.frameWait)
+		pgr.frameWait = nil
+	}
+	pgr.waitMu.Unlock()
+}
+
+// For new pages that don't exist yet. Ids handed back with Reuse are used up before the
+// file is extended.
 //
 // todo: fallocate if needed - we dont strictly need to though
 func (pgr *Pager) CreatePage() *Frame {
-	pgr.frameMapMu.Lock()
+	frame, _ := pgr.createNextPage()
+	return frame
+}
 
-	frameIndex, foundFreeFrame := pgr.getFreeFrame()
+// CreatePage, with why it didn't get a frame
+func (pgr *Pager) createNextPage() (*Frame, error) {
+	pgr.idMu.Lock()
+	defer pgr.idMu.Unlock()
 
-	if !foundFreeFrame {
-		pgr.frameMapMu.Unlock()
-		return nil
+	if n := len(pgr.reusable); n > 0 {
+		frame, err := pgr.createPage(pgr.reusable[n-1])
+		if err == nil {
+			pgr.reusable = pgr.reusable[:n-1]
+		}
+		return frame, err
 	}
 
-	pageId := pgr.nextId
-	pgr.nextId++
+	frame, err := pgr.createPage(pgr.nextId)
+	if err == nil {
+		pgr.nextId++
+	}
+	return frame, err
+}
+
+// Hands page ids back to the pager, CreatePage will hand them out again before extending
+// the file. Nobody may be holding (or be about to get) the old contents of these pages.
+func (pgr *Pager) Reuse(ids ...uint64) {
+	pgr.idMu.Lock()
+	defer pgr.idMu.Unlock()
+	pgr.reusable = append(pgr.reusable, ids...)
+}
+
+// Copy of the ids waiting to be reused
+func (pgr *Pager) Reusable() []uint64 {
+	pgr.idMu.Lock()
+	defer pgr.idMu.Unlock()
+	return slices.Clone(pgr.reusable)
+}
+
+// Like CreatePage, but for pages that live at a well-known id (eg. a meta page) rather than
+// one handed out by the pager. Whatever was at that id before is overwritten.
+func (pgr *Pager) CreatePageAt(pageId uint64) *Frame {
+	pgr.idMu.Lock()
+	defer pgr.idMu.Unlock()
+
+	frame, _ := pgr.createPage(pageId)
+	if frame != nil && pageId >= pgr.nextId {
+		pgr.nextId = pageId + 1
+	}
+	return frame
+}
+
+// Must be called with idMu held (so the id can't be handed out twice).
+func (pgr *Pager) createPage(pageId uint64) (*Frame, error) {
+	shard := pgr.shardOf(pageId)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	return pgr.createPageLocked(shard, pageId)
+}
 
-	pgr.frameMap[pageId] = frameIndex
+// Must be called with the shard's lock held. If an old version of the page is still cached
+// we take over its frame (whatever it held is garbage now, dirty or not), otherwise we grab
+// a free one.
+func (pgr *Pager) createPageLocked(shard *shard, pageId uint64) (*Frame, error) {
+	frameIndex, found := shard.frameMap[pageId]
+	if found && pgr.frames[frameIndex].reading() {
+		// a read (likely a Prefetch) would land on top of the new page
+		ch := pgr.frames[frameIndex].diskOp.Ch
+		shard.mu.Unlock()
+		<- ch
+		shard.mu.Lock()
+		return pgr.createPageLocked(shard, pageId)
+	}
+	if !found {
+		var err error
+		frameIndex, err = pgr.claimFrame(shard)
+		if err != nil {
+			return nil, err
+		}
+		if _, found := shard.frameMap[pageId]; found {
+			shard.freeFrames = append(shard.freeFrames, frameIndex)
+			return pgr.createPageLocked(shard, pageId)
+		}
+		shard.frameMap[pageId] = frameIndex
+	}
 
 	frame := &pgr.frames[frameIndex]
 	frame.pins.Add(1)
+	frame.ref = false
+	frame.dirty = false
+	frame.gen = 0
 	frame.pageId = pageId
+	frame.err = nil
+	frame.state.Store(frameReady)
+	// nothing to load, the page only exists in memory for now
+	frame.diskOp.Res = 0
+	frame.diskOp.Ch = doneCh
+
+	return frame, nil
+}
 
-	pgr.frameMapMu.Unlock()
+// Id the next CreatePage will use, ie. how many pages the file has (or will have)
+func (pgr *Pager) NextId() uint64 {
+	pgr.idMu.Lock()
+	defer pgr.idMu.Unlock()
+	return pgr.nextId
+}
 
-	return frame
+func (pgr *Pager) SetNextId(nextId uint64) {
+	pgr.idMu.Lock()
+	defer pgr.idMu.Unlock()
+	pgr.nextId = nextId
+}
+
+// Writes a page out right away and waits for it, whether it's dirty or not. For pages that
+// have to hit the disk in a particular order (eg. meta pages) - everything else can just
+// MarkDirty and leave it to eviction or Flush.
+func (pgr *Pager) WritePage(frame *Frame) error {
+	shard := frame.shard
+	shard.mu.Lock()
+	for frame.writing {
+		ch := frame.writeDone
+		shard.mu.Unlock()
+		<- ch
+		shard.mu.Lock()
+	}
+	pgr.beginWrite(frame)
+	shard.mu.Unlock()
+
+	return pgr.writeBack([]*Frame{frame})
 }
 
-func (pgr *Pager) WritePage(frame *Frame) {
-	frame.prepareOp(system.OpWrite)
-	pgr.iomgr.OpQueue <- &frame.diskOp
+// Writes back every dirty page changed in generation gen or before, and waits for them (and
+// any write-back already in flight) to land. Doesn't sync.
+func (pgr *Pager) Flush(gen uint64) error {
+	for {
+		var batch []*Frame
+		var inflight chan struct{}
+
+		for i := range pgr.shards {
+			shard := &pgr.shards[i]
+			shard.mu.Lock()
+			for _, index := range shard.frames {
+				frame := &pgr.frames[index]
+				if frame.writing {
+					if inflight == nil { inflight = frame.writeDone }
+					continue
+				}
+				if frame.dirty && frame.gen <= gen {
+					pgr.beginWrite(frame)
+					batch = append(batch, frame)
+				}
+			}
+			shard.mu.Unlock()
+		}
+
+		if len(batch) > 0 {
+			if err := pgr.writeBack(batch); err != nil { return err }
+		} else if inflight != nil {
+			<- inflight
+		} else {
+			return nil
+		}
+	}
+}
 
-	// TODO temporary
-	<- frame.diskOp.Ch
+// Must be called with the frame's shard lock held, and the frame mustn't be writing already.
+// Pins the frame so it stays put until writeBack is done with it.
+//
+// The frame is marked clean before the write even starts - if it gets dirtied again in the
+// meantime, that sticks, and it gets written again later.
+//
+// writeDone is made here, under the lock, so anyone who sees writing set has something to
+// wait on - even if writeBack hasn't got around to submitting anything yet.
+func (pgr *Pager) beginWrite(frame *Frame) {
+	frame.pins.Add(1)
+	frame.writing = true
+	frame.dirty = false
+	frame.writeDone = make(chan struct{})
+}
+
+// Writes out frames that went through beginWrite, all submitted at once so IoMgr can batch
+// them, then waits for all of them. Frames that failed (or were only partly written) are
+// dirty again afterwards.
+//
+// Frames whose pages sit next to each other in the file go out together as one writev,
+// carried by the first frame's writeOp. writeOp is writeBack's alone - others wait on
+// writeDone, which is closed once the frame's write is over and accounted for.
+func (pgr *Pager) writeBack(frames []*Frame) error {
+	slices.SortFunc(frames, func(a, b *Frame) int { return cmp.Compare(a.pageId, b.pageId) })
+
+	var runs [][]*Frame
+	for start := 0; start < len(frames); {
+		end := start + 1
+		for end < len(frames) && end - start < WRITEBACK_RUN_MAX &&
+			frames[end].pageId == frames[end-1].pageId + 1 {
+			end++
+		}
+		runs = append(runs, frames[start:end])
+		start = end
+	}
+
+	bufs := make([][]byte, 0, WRITEBACK_RUN_MAX)
+	for _, run := range runs {
+		lead := run[0]
+		offset := c.PageIdToOffset(lead.pageId)
+		if len(run) == 1 {
+			lead.writeOp.PrepareOpSlice(system.OpWrite, lead.data, offset)
+		} else {
+			bufs = bufs[:0]
+			for _, frame := range run {
+				bufs = append(bufs, frame.data)
+			}
+			lead.writeOp.PrepareOpVec(system.OpWritev, bufs, offset)
+		}
+		pgr.io.Submit(&lead.writeOp)
+	}
+
+	var err error
+	for _, run := range runs {
+		lead := run[0]
+		<- lead.writeOp.Ch
+		res := lead.writeOp.Res
+		if res >= 0 && int(res) < len(run) * c.PAGE_SIZE {
+			// a short write - no telling which of the pages made it, so none of them did
+			res = -int32(syscall.EIO)
+		}
+		for _, frame := range run {
+			frame.writeOp.Res = res
+		}
+		if err == nil {
+			err = pgr.ioErr(system.OpWrite, lead.pageId, res)
+		}
+	}
+
+	for _, frame := range frames {
+		frame.shard.mu.Lock()
+		frame.writing = false
+		if frame.writeOp.Res < 0 {
+			frame.dirty = true
+		}
+		close(frame.writeDone) // "broadcast"
+		frame.shard.mu.Unlock()
+	}
+
+	for _, frame := range frames {
+		frame.Release()
+	}
+	return err
+}
+
+// Drops cached pages without writing them back, ie. ones that were never committed. They
+// must not be pinned by anyone who is going to look at them.
+func (pgr *Pager) Discard(ids ...uint64) {
+	defer pgr.wakeWaiters()
+
+	for _, pageId := range ids {
+		shard := pgr.shardOf(pageId)
+		shard.mu.Lock()
+		index, found := shard.frameMap[pageId]
+		if found {
+			frame := &pgr.frames[index]
+			frame.dirty = false
+			if frame.pins.Load() == 0 && !frame.reading() {
+				delete(shard.frameMap, pageId)
+				shard.freeFrames = append(shard.freeFrames, index)
+			}
+		}
+		shard.mu.Unlock()
+	}
 }
 
 // NOTE: there is no notion of "deleting a page" at the file io level - this would just be 
@@ -164,12 +759,9 @@ func (pgr *Pager) WritePage(frame *Frame) {
 
 func (pgr *Pager) Sync() error {
 	pgr.diskOp.PrepareOpSlice(system.OpSync, nil, 0)
-	pgr.iomgr.OpQueue <- &pgr.diskOp
+	pgr.io.Submit(&pgr.diskOp)
 	<- pgr.diskOp.Ch
-	if pgr.diskOp.Res < 0 {
-		return pagerErr(int(pgr.diskOp.Res))
-	} 
-	return nil
+	return pgr.ioErr(system.OpSync, 0, pgr.diskOp.Res)
 }
 
 // A Frame has a "lifetime" which corresponds to the time that it refers to a certain page-id
@@ -178,6 +770,10 @@ func (pgr *Pager) Sync() error {
 // The "wait" channel is created once at the beginning of its lifetime and never is
 // re-initialized unless the Frame begins again with a new page-id
 //
+// Within a lifetime a frame goes from loading to either ready or failed, the first time
+// someone Waits on it after its read completes. Frames that never needed a read (CreatePage)
+// start out ready.
+//
 // Note: If you try to access a Frame after unpinning it the universe will explode instantly
 type Frame struct {
 	frameIndex int // mostly for debugging
@@ -187,11 +783,27 @@ type Frame struct {
 	pins   	atomic.Int32
 
 	pager 	*Pager
-	_pad 	[8]byte
-
-	diskOp system.DiskOp // a frame owns its own diskop it can reuse
+	shard 	*shard // the one it belongs to, for good
+	ref 	bool // CLOCK reference bit - guarded by shard.mu
+	dirty 	bool // changed since it was last written - guarded by shard.mu
+	writing bool // write-back in flight - guarded by shard.mu
+	_pad 	[5]byte
+	gen 	uint64 // generation of the last change - guarded by shard.mu
+	writeDone chan struct{} // closed once the write-back is over - guarded by shard.mu
+
+	state 	atomic.Uint32 // frameLoading, frameReady or frameFailed
+	err 	error // why the read failed - set before state becomes frameFailed
+
+	diskOp 	system.DiskOp // a frame owns its own diskop it can reuse, for reads
+	writeOp system.DiskOp // and one for writes, so readers waiting on a load never race it
 }
 
+const (
+	frameLoading uint32 = iota
+	frameReady
+	frameFailed
+)
+
 // Just to remember what we need to set initially. Other fields should be set when
 // the frame is initialized with a page_id and corresponding disk-op
 func (frm *Frame) init(frameId int, data []byte) {
@@ -199,16 +811,67 @@ func (frm *Frame) init(frameId int, data []byte) {
 	frm.data = data
 }
 
+// Whether a read into the frame is still in flight. Unpinned frames can be in this state
+// after a Prefetch, and mustn't be reused until it lands. Called with the shard's lock held.
+func (frm *Frame) reading() bool {
+	if frm.state.Load() != frameLoading { return false }
+	select {
+	case <- frm.diskOp.Ch:
+		return false
+	default:
+		return true
+	}
+}
+
 func (frm *Frame) BufferHandle() []byte {
 	return frm.data
 }
 
+// Blocks until the page has been read in. Frames from CreatePage are ready immediately.
+// Everyone who got the frame while it was loading waits on the same read, and gets the same
+// *IOError if it failed, or *ErrPageCorrupt if what came back doesn't check out.
+//
+// A failed frame is taken out of the framemap, so the next GetPage for the page tries the
+// read again in a fresh frame instead of handing out this one.
+func (frm *Frame) Wait() error {
+	switch frm.state.Load() {
+	case frameReady:
+		return nil
+	case frameFailed:
+		return frm.err
+	}
+
+	<- frm.diskOp.Ch
+	err := frm.pager.ioErr(system.OpRead, frm.pageId, frm.diskOp.Res)
+	if err == nil {
+		err = verifyPage(frm.pageId, frm.data)
+	}
+	if err == nil {
+		frm.state.CompareAndSwap(frameLoading, frameReady)
+		return nil
+	}
+
+	shard := frm.shard
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if frm.state.Load() == frameLoading {
+		frm.err = err
+		frm.state.Store(frameFailed)
+		if mapped, found := shard.frameMap[frm.pageId]; found && mapped == frm.frameIndex {
+			delete(shard.frameMap, frm.pageId)
+		}
+	}
+	return frm.err
+}
+
 // Unpins frame (by one)
+//
+// The frame stays cached until the CLOCK sweep gets around to evicting it. No lock needed,
+// frames are only pinned (and checked for pins before eviction) under their shard's lock, so
+// at worst a frame looks pinned for one sweep longer than it is.
 func (frm *Frame) Release() {
-	old := frm.pins.Add(-1)
-	// TODO: this is temporary and makes it so pages are simply not cached
-	if old == 0 {
-		frm.pager.freeFrames <- frm.frameIndex
+	if frm.pins.Add(-1) == 0 {
+		frm.pager.wakeWaiters()
 	}
 }
 
@@ -216,6 +879,19 @@ func (frm *Frame) PageId() uint64 {
 	return frm.pageId
 }
 
-func (frm *Frame) prepareOp(opcode system.OpCode) {
-	frm.diskOp.PrepareOpSlice(opcode, frm.data, c.PageIdToOffset(frm.pageId))
+// Flags the page as changed in generation gen, so it gets written back before the frame is
+// reused, or by the next Flush that covers gen. The caller must have it pinned, and be done
+// changing it for now.
+func (frm *Frame) MarkDirty(gen uint64) {
+	frm.shard.mu.Lock()
+	frm.dirty = true
+	frm.gen = max(frm.gen, gen)
+	frm.shard.mu.Unlock()
+}
+
+// Whether the page has changes that haven't been written back yet
+func (frm *Frame) Dirty() bool {
+	frm.shard.mu.Lock()
+	defer frm.shard.mu.Unlock()
+	return frm.dirty
 }
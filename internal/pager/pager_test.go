@@ -2,12 +2,17 @@ package pager
 
 import (
 	c "mooodb/internal"
+	"mooodb/internal/system"
 
+	"context"
 	"fmt"
 	"math/rand"
-	"os"
 	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -17,9 +22,30 @@ func tempfile(t *testing.T) string {
 	return filepath.Join(dir, fmt.Sprintf("moootest%016x.moo", rand.Uint64()))
 }
 
+// Most tests don't need a real disk underneath them
+var memfs = system.NewMemFS()
+
+func memfile() string {
+	return fmt.Sprintf("moootest%016x.moo", rand.Uint64())
+}
+
+// Stamps the page id and checksum the way the btree would, so reads of it pass verification
+func stamp(data []byte, pageId uint64) {
+	c.Bin.PutUint64(data[c.PAGE_OFF_ID:], pageId)
+	c.Bin.PutUint64(data[c.PAGE_OFF_CHECKSUM:], c.PageChecksum(data))
+}
+
+// Fills a page with one byte (past the header, at least)
+func fill(f *Frame, b byte) {
+	for i := range f.data {
+		f.data[i] = b
+	}
+	stamp(f.data, f.pageId)
+}
+
 func Test_Pager_None_Free(t *testing.T) {
 	const COUNT = 8
-	pager, err := CreatePager(tempfile(t), COUNT)
+	pager, err := CreatePagerWith(memfs.Open, memfile(), COUNT)
 	assert.NoError(t, err)
 	if err != nil { t.Fatal() }
 
@@ -37,7 +63,7 @@ func Test_Pager_None_Free(t *testing.T) {
 
 func Test_Pager_Should_Evict(t *testing.T) {
 	const COUNT = 8
-	pager, err := CreatePager(tempfile(t), COUNT)
+	pager, err := CreatePagerWith(memfs.Open, memfile(), COUNT)
 	assert.NoError(t, err)
 	if err != nil { t.Fatal() }
 
@@ -62,7 +88,7 @@ func Test_Pager_Should_Evict(t *testing.T) {
 }
 
 func Test_Pager_Main(t *testing.T) {
-	pager, err := CreatePager(tempfile(t), 16)
+	pager, err := CreatePagerWith(memfs.Open, memfile(), 16)
 	assert.NoError(t, err)
 	if err != nil { t.Fatal() }
 
@@ -74,6 +100,8 @@ func Test_Pager_Main(t *testing.T) {
 	for i := range f1.data {
 		f1.data[i] = byte(i)
 	}
+	stamp(f1.data, pageId)
+	expected := slices.Clone(f1.data)
 
 	pager.WritePage(f1)
 	<- f1.diskOp.Ch
@@ -89,9 +117,7 @@ func Test_Pager_Main(t *testing.T) {
 	assert.Equal(t, f1.frameIndex, f2.frameIndex)
 	assert.Equal(t, f1.frameIndex, f3.frameIndex)
 
-	for i := range f2.data {
-		assert.Equal(t, f2.data[i], byte(i))
-	}
+	assert.Equal(t, expected, f2.data)
 
 	pager.Close()
 }
@@ -122,7 +148,7 @@ func Test_Pager_Fsync(t *testing.T) {
 
 
 func Test_Pager_Multiread(t *testing.T) {
-	fp := tempfile(t)
+	fp := memfile()
 
 	// pre-populate
 	// root page is page 0, so we need to populate 0-8 * pagesize
@@ -131,11 +157,12 @@ func Test_Pager_Multiread(t *testing.T) {
 	for i := range data {
 		data[i] = byte(rand.Uint32())
 	}
-	err := os.WriteFile(fp, data, 0644)
-	assert.NoError(t, err)
-	if err != nil { t.Fatal() }
+	for pageId := range uint64(9) {
+		stamp(data[c.PageIdToOffset(pageId):c.PageIdToOffset(pageId + 1)], pageId)
+	}
+	memfs.WriteFile(fp, data)
 
-	pager, err := CreatePager(fp, 8)
+	pager, err := CreatePagerWith(memfs.Open, fp, 8)
 	assert.NoError(t, err)
 	if err != nil { t.Fatal() }
 
@@ -160,8 +187,644 @@ func Test_Pager_Multiread(t *testing.T) {
 		<- fop.Ch
 		assert.GreaterOrEqual(t, fop.Res, int32(0))
 		assert.Equal(t, c.PAGE_SIZE, int(fop.Res))
+		assert.NoError(t, frames[i].Wait())
 	}
 
 	pager.Close()
 }
 
+
+func Test_Pager_Open(t *testing.T) {
+	fp := memfile()
+
+	_, err := OpenPagerWith(memfs.Open, fp, 8)
+	assert.Error(t, err, "file doesn't exist yet")
+
+	pager, err := CreatePagerWith(memfs.Open, fp, 8)
+	if err != nil { t.Fatal(err) }
+	for range 4 {
+		f := pager.CreatePage()
+		fill(f, byte(f.pageId))
+		assert.NoError(t, pager.WritePage(f))
+		f.Release()
+	}
+	pager.Close()
+
+	pager, err = OpenPagerWith(memfs.Open, fp, 8)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+
+	// ids 1-4 were written, so the file is 5 pages long
+	assert.Equal(t, uint64(5), pager.NextId())
+	f := pager.CreatePage()
+	assert.Equal(t, uint64(5), f.pageId)
+	f.Release()
+
+	f = pager.GetPage(3)
+	assert.NoError(t, f.Wait())
+	assert.Equal(t, byte(3), f.data[c.PAGE_SIZE-1])
+	f.Release()
+}
+
+func Test_Pager_CreatePageAt(t *testing.T) {
+	pager, err := CreatePagerWith(memfs.Open, memfile(), 8)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+
+	f := pager.CreatePageAt(0)
+	assert.Equal(t, uint64(0), f.pageId)
+	assert.Equal(t, uint64(1), pager.NextId(), "below nextId, shouldn't change it")
+	f.Release()
+
+	f = pager.CreatePageAt(6)
+	assert.Equal(t, uint64(7), pager.NextId())
+	f.Release()
+
+	// still cached, so it should get the same frame back
+	f2 := pager.CreatePageAt(6)
+	assert.Equal(t, f.frameIndex, f2.frameIndex)
+	f2.Release()
+
+	pager.SetNextId(100)
+	f = pager.CreatePage()
+	assert.Equal(t, uint64(100), f.pageId)
+	f.Release()
+}
+
+func Test_Pager_Reuse(t *testing.T) {
+	pager, err := CreatePagerWith(memfs.Open, memfile(), 8)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+
+	for range 4 {
+		pager.CreatePage().Release()
+	}
+
+	pager.Reuse(2, 3)
+	assert.ElementsMatch(t, []uint64{2, 3}, pager.Reusable())
+
+	ids := []uint64{}
+	for range 3 {
+		f := pager.CreatePage()
+		ids = append(ids, f.pageId)
+		f.Release()
+	}
+
+	assert.ElementsMatch(t, []uint64{2, 3, 5}, ids, "reused ids come first")
+	assert.Empty(t, pager.Reusable())
+	assert.Equal(t, uint64(6), pager.NextId())
+}
+
+func Test_Pager_Clock(t *testing.T) {
+	const COUNT = 8
+	pager, err := CreatePagerWith(memfs.Open, memfile(), COUNT)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+
+	for range COUNT * 4 {
+		f := pager.CreatePage()
+		fill(f, byte(f.pageId))
+		assert.NoError(t, pager.WritePage(f))
+		f.Release()
+	}
+
+	hot := pager.GetPage(1)
+	assert.NoError(t, hot.Wait())
+	hotIndex := hot.frameIndex
+	hot.Release()
+
+	// a scan over everything else, with the hot page touched in between - it should never
+	// be evicted
+	for pageId := uint64(2); pageId <= COUNT * 4; pageId++ {
+		f := pager.GetPage(pageId)
+		assert.NoError(t, f.Wait())
+		assert.Equal(t, byte(pageId), f.data[c.PAGE_SIZE-1])
+		f.Release()
+
+		hot = pager.GetPage(1)
+		assert.Equal(t, hotIndex, hot.frameIndex, "hot page was evicted")
+		hot.Release()
+	}
+
+	// evicted pages don't linger in the map
+	for i := range pager.shards {
+		shard := &pager.shards[i]
+		shard.mu.Lock()
+		assert.LessOrEqual(t, len(shard.frameMap), COUNT)
+		for pageId, index := range shard.frameMap {
+			assert.Equal(t, pageId, pager.frames[index].pageId)
+		}
+		shard.mu.Unlock()
+	}
+
+	// pinned frames are never picked
+	var pinned []*Frame
+	for pageId := range uint64(COUNT) {
+		f := pager.GetPage(pageId + 1)
+		assert.NotNil(t, f)
+		pinned = append(pinned, f)
+	}
+	assert.Nil(t, pager.GetPage(COUNT + 1))
+	for _, f := range pinned {
+		assert.NoError(t, f.Wait())
+		assert.Equal(t, byte(f.pageId), f.data[c.PAGE_SIZE-1])
+		f.Release()
+	}
+	f := pager.GetPage(COUNT + 1)
+	assert.NotNil(t, f)
+	f.Release()
+}
+
+func Test_Pager_Dirty_Eviction(t *testing.T) {
+	const COUNT = 4
+	pager, err := CreatePagerWith(memfs.Open, memfile(), COUNT)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+
+	// never written explicitly - eviction has to do it
+	for range COUNT * 4 {
+		f := pager.CreatePage()
+		assert.NotNil(t, f)
+		fill(f, byte(f.pageId))
+		f.MarkDirty(1)
+		assert.True(t, f.Dirty())
+		f.Release()
+	}
+
+	for pageId := uint64(1); pageId <= COUNT * 4; pageId++ {
+		f := pager.GetPage(pageId)
+		assert.NotNil(t, f)
+		assert.NoError(t, f.Wait())
+		assert.Equal(t, byte(pageId), f.data[c.PAGE_SIZE/2])
+		assert.Equal(t, byte(pageId), f.data[c.PAGE_SIZE-1])
+		f.Release()
+	}
+
+	// all pinned and dirty - nothing can be evicted
+	var pinned []*Frame
+	for range COUNT {
+		f := pager.CreatePage()
+		f.MarkDirty(1)
+		pinned = append(pinned, f)
+	}
+	assert.Nil(t, pager.CreatePage())
+	for _, f := range pinned {
+		f.Release()
+	}
+	f := pager.CreatePage()
+	assert.NotNil(t, f)
+	f.Release()
+}
+
+func Test_Pager_Flush(t *testing.T) {
+	fp := memfile()
+	pager, err := CreatePagerWith(memfs.Open, fp, 16)
+	if err != nil { t.Fatal(err) }
+
+	var frames []*Frame
+	for i := range 8 {
+		f := pager.CreatePage()
+		fill(f, byte(f.pageId))
+		f.MarkDirty(uint64(1 + i % 2))
+		frames = append(frames, f)
+	}
+
+	assert.NoError(t, pager.Flush(1))
+	for i, f := range frames {
+		assert.Equal(t, i % 2 == 1, f.Dirty(), "only gen 1 is flushed")
+	}
+
+	// changes made while pinned stick around until they're flushed too
+	frames[0].MarkDirty(1)
+	assert.NoError(t, pager.Flush(2))
+	for _, f := range frames {
+		assert.False(t, f.Dirty())
+		f.Release()
+	}
+	assert.NoError(t, pager.Sync())
+
+	// dropped pages never make it to disk
+	f := pager.CreatePage()
+	discarded := f.pageId
+	f.data[0] = 0xee
+	f.MarkDirty(3)
+	f.Release()
+	pager.Discard(discarded)
+	assert.NoError(t, pager.Flush(3))
+	pager.Close()
+
+	pager, err = OpenPagerWith(memfs.Open, fp, 16)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+	assert.Equal(t, discarded, pager.NextId(), "nothing was written past the flushed pages")
+	for pageId := uint64(1); pageId <= 8; pageId++ {
+		f := pager.GetPage(pageId)
+		assert.NoError(t, f.Wait())
+		assert.Equal(t, byte(pageId), f.data[c.PAGE_SIZE-1])
+		f.Release()
+	}
+}
+
+func Test_Pager_Close_Flushes(t *testing.T) {
+	fp := memfile()
+	pager, err := CreatePagerWith(memfs.Open, fp, 8)
+	if err != nil { t.Fatal(err) }
+
+	for range 4 {
+		f := pager.CreatePage()
+		fill(f, byte(f.pageId))
+		f.MarkDirty(1)
+		f.Release()
+	}
+	assert.NoError(t, pager.Close())
+
+	pager, err = OpenPagerWith(memfs.Open, fp, 8)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+	assert.Equal(t, uint64(5), pager.NextId())
+	for pageId := uint64(1); pageId <= 4; pageId++ {
+		f := pager.GetPage(pageId)
+		assert.NoError(t, f.Wait())
+		assert.Equal(t, byte(pageId), f.data[c.PAGE_SIZE-1])
+		f.Release()
+	}
+}
+
+func Test_Pager_Flush_Pending_Write(t *testing.T) {
+	pager, err := CreatePagerWith(memfs.Open, memfile(), 8)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+
+	f := pager.CreatePage()
+	fill(f, 1)
+	f.MarkDirty(1)
+	f.Release()
+
+	// eviction picked the frame for write-back, but hasn't submitted the write yet
+	f.shard.mu.Lock()
+	pager.beginWrite(f)
+	f.shard.mu.Unlock()
+
+	flushed := make(chan error)
+	go func() { flushed <- pager.Flush(1) }()
+	select {
+	case <- flushed:
+		t.Fatal("Flush returned before the write was even submitted")
+	case <- time.After(50 * time.Millisecond):
+	}
+
+	assert.NoError(t, pager.writeBack([]*Frame{f}))
+	assert.NoError(t, <- flushed)
+}
+
+func Test_Pager_GetPageCtx(t *testing.T) {
+	const COUNT = 2
+	pager, err := CreatePagerWith(memfs.Open, memfile(), COUNT)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+
+	// the pages the waiters are after below
+	for range 4 {
+		f := pager.CreatePage()
+		fill(f, byte(f.pageId))
+		assert.NoError(t, pager.WritePage(f))
+		f.Release()
+	}
+
+	var pinned []*Frame
+	for range COUNT {
+		f, err := pager.CreatePageCtx(context.Background())
+		assert.NoError(t, err)
+		pinned = append(pinned, f)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+	defer cancel()
+	f, err := pager.GetPageCtx(ctx, pinned[0].pageId + 100)
+	assert.Nil(t, f)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// waiters queue up until frames come free
+	const WAITERS = 16
+	got := make(chan *Frame)
+	for i := range WAITERS {
+		go func() {
+			f, err := pager.GetPageCtx(context.Background(), uint64(i % 4 + 1))
+			assert.NoError(t, err)
+			got <- f
+		}()
+	}
+	for _, f := range pinned {
+		f.Release()
+	}
+	for range WAITERS {
+		f := <- got
+		assert.NoError(t, f.Wait())
+		f.Release()
+	}
+}
+
+func Test_Pager_Read_Error(t *testing.T) {
+	pager, err := CreatePager(tempfile(t), 8)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+
+	// offset ends up negative, which the kernel won't take
+	const BAD_ID = (1 << 63) / c.PAGE_SIZE
+
+	// everyone who got the frame while it was loading sees the same failure
+	f1 := pager.GetPage(BAD_ID)
+	f2 := pager.GetPage(BAD_ID)
+	assert.Equal(t, f1, f2)
+	err1, err2 := f1.Wait(), f2.Wait()
+	assert.Error(t, err1)
+	assert.Equal(t, err1, err2)
+
+	var ioErr *IOError
+	assert.ErrorAs(t, err1, &ioErr)
+	assert.Equal(t, uint64(BAD_ID), ioErr.PageId)
+	assert.ErrorIs(t, err1, syscall.EINVAL)
+	assert.NotErrorIs(t, err1, ErrIOFailed, "one bad op doesn't take the backend down")
+
+	// the failed frame isn't handed out again, the read is retried in a new one
+	f3 := pager.GetPage(BAD_ID)
+	assert.NotEqual(t, f1, f3)
+	assert.Error(t, f3.Wait())
+	f1.Release()
+	f2.Release()
+	f3.Release()
+
+	f := pager.CreatePage()
+	assert.NoError(t, f.Wait())
+	f.Release()
+}
+
+func Test_Pager_IO_Failed(t *testing.T) {
+	var fb *system.FaultBackend
+	open := system.FaultOpener(memfs.Open, system.FaultPlan{}, func(opened *system.FaultBackend) { fb = opened })
+	pager, err := CreatePagerWith(open, memfile(), 8)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+
+	f := pager.CreatePage()
+	fill(f, 1)
+	assert.NoError(t, pager.WritePage(f))
+	f.Release()
+
+	// once the backend is gone every op fails, and says why
+	fb.Crash()
+	err = pager.Sync()
+	var ioErr *IOError
+	assert.ErrorAs(t, err, &ioErr)
+	assert.Equal(t, system.OpSync, ioErr.Op)
+	assert.ErrorIs(t, err, ErrIOFailed, "the backend is gone, not just the op")
+	assert.ErrorIs(t, err, system.ErrCrashed)
+
+	f = pager.GetPage(2)
+	assert.ErrorIs(t, f.Wait(), ErrIOFailed)
+	f.Release()
+}
+
+func Test_Pager_Short_Write(t *testing.T) {
+	open := system.FaultOpener(memfs.Open, system.FaultPlan{
+		At: map[uint64]system.Fault{ 1: system.FaultShort },
+	}, nil)
+	pager, err := CreatePagerWith(open, memfile(), 8)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+
+	var frames []*Frame
+	for range 3 {
+		f := pager.CreatePage()
+		fill(f, byte(f.pageId))
+		f.MarkDirty(1)
+		frames = append(frames, f)
+	}
+
+	// one writev for all three, and it doesn't get all the way
+	err = pager.Flush(1)
+	var ioErr *IOError
+	assert.ErrorAs(t, err, &ioErr)
+	assert.ErrorIs(t, err, syscall.EIO)
+	for _, f := range frames {
+		assert.True(t, f.Dirty(), "page %d counted as written", f.pageId)
+	}
+
+	assert.NoError(t, pager.Flush(1))
+	for _, f := range frames {
+		assert.False(t, f.Dirty())
+		f.Release()
+	}
+}
+
+func Test_Pager_GetPageCtx_Write_Error(t *testing.T) {
+	var fb *system.FaultBackend
+	open := system.FaultOpener(memfs.Open, system.FaultPlan{}, func(opened *system.FaultBackend) { fb = opened })
+	pager, err := CreatePagerWith(open, memfile(), 4)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+
+	for range 4 {
+		f := pager.CreatePage()
+		fill(f, byte(f.pageId))
+		f.MarkDirty(1)
+		f.Release()
+	}
+	fb.Crash()
+
+	// every frame needs writing back to be of use, and that can't work anymore - waiting
+	// would only retry it forever
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	_, err = pager.GetPageCtx(ctx, 99)
+	assert.ErrorIs(t, err, ErrIOFailed)
+	_, err = pager.CreatePageCtx(ctx)
+	assert.ErrorIs(t, err, ErrIOFailed)
+	assert.NoError(t, ctx.Err(), "gave up on the write, not the deadline")
+}
+
+func Test_Pager_Corrupt(t *testing.T) {
+	fp := memfile()
+	pager, err := CreatePagerWith(memfs.Open, fp, 8)
+	if err != nil { t.Fatal(err) }
+	for range 3 {
+		f := pager.CreatePage()
+		fill(f, byte(f.pageId))
+		assert.NoError(t, pager.WritePage(f))
+		f.Release()
+	}
+	pager.Close()
+
+	file := memfs.File(fp)
+	// a torn write on page 1, and page 2 written where page 3 should be
+	_, err = file.WriteAt([]byte{0xff}, int64(c.PageIdToOffset(1)) + c.PAGE_SIZE/2)
+	assert.NoError(t, err)
+	misdirected := make([]byte, c.PAGE_SIZE)
+	_, err = file.ReadAt(misdirected, int64(c.PageIdToOffset(2)))
+	assert.NoError(t, err)
+	_, err = file.WriteAt(misdirected, int64(c.PageIdToOffset(3)))
+	assert.NoError(t, err)
+
+	pager, err = OpenPagerWith(memfs.Open, fp, 8)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+
+	var corrupt *ErrPageCorrupt
+
+	f := pager.GetPage(1)
+	err = f.Wait()
+	assert.ErrorAs(t, err, &corrupt)
+	assert.Equal(t, uint64(1), corrupt.PageId)
+	assert.NotEqual(t, corrupt.Expected, corrupt.Actual)
+	f.Release()
+
+	f = pager.GetPage(2)
+	assert.NoError(t, f.Wait())
+	f.Release()
+
+	f = pager.GetPage(3)
+	err = f.Wait()
+	assert.ErrorAs(t, err, &corrupt)
+	assert.Equal(t, uint64(3), corrupt.PageId)
+	assert.Equal(t, uint64(2), corrupt.StoredId)
+	assert.Equal(t, corrupt.Expected, corrupt.Actual)
+	f.Release()
+}
+
+func Test_Pager_Sharded(t *testing.T) {
+	const COUNT = 1024
+	const PAGES = COUNT * 2
+	pager, err := CreatePagerWith(memfs.Open, memfile(), COUNT)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+	assert.Equal(t, COUNT / SHARD_MIN_FRAMES, len(pager.shards))
+
+	for range PAGES {
+		f := pager.CreatePage()
+		if f == nil { t.Fatal("shards ran out of frames") }
+		fill(f, byte(f.pageId))
+		f.MarkDirty(1)
+		f.Release()
+	}
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Go(func() {
+			for i := range PAGES {
+				pageId := uint64((i + w * 97) % PAGES + 1)
+				f, err := pager.GetPageCtx(context.Background(), pageId)
+				assert.NoError(t, err)
+				assert.NoError(t, f.Wait())
+				assert.Equal(t, byte(pageId), f.data[c.PAGE_SIZE-1])
+				assert.Equal(t, pager.shardOf(pageId), f.shard, "page outside its own shard")
+				f.Release()
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// GetPage/Release on resident pages, ie. just the page table, sharded and not
+func Benchmark_Pager_GetPage_Parallel(b *testing.B) {
+	const COUNT = 1024
+	const PAGES = COUNT / 2
+
+	for _, shards := range []int{1, COUNT / SHARD_MIN_FRAMES} {
+		pager, err := createPager(memfs.Open, memfile(), true, COUNT, shards)
+		if err != nil { b.Fatal(err) }
+		for range PAGES {
+			f := pager.CreatePage()
+			fill(f, byte(f.pageId))
+			f.Release()
+		}
+
+		for _, workers := range []int{1, 2, 4, 8, 16, 32, 64} {
+			b.Run(fmt.Sprintf("shards=%d/workers=%d", shards, workers), func(b *testing.B) {
+				var wg sync.WaitGroup
+				b.ResetTimer()
+				for w := range workers {
+					// b.N split evenly, the first few pick up the remainder
+					n := b.N / workers
+					if w < b.N % workers { n++ }
+					wg.Go(func() {
+						rng := rand.New(rand.NewSource(int64(w)))
+						for range n {
+							f := pager.GetPage(uint64(rng.Intn(PAGES) + 1))
+							f.Release()
+						}
+					})
+				}
+				wg.Wait()
+			})
+		}
+		pager.Close()
+	}
+}
+
+func Test_Pager_Prefetch(t *testing.T) {
+	const COUNT = 8
+	fp := memfile()
+	pager, err := CreatePagerWith(memfs.Open, fp, COUNT)
+	if err != nil { t.Fatal(err) }
+	for range COUNT * 2 {
+		f := pager.CreatePage()
+		fill(f, byte(f.pageId))
+		assert.NoError(t, pager.WritePage(f))
+		f.Release()
+	}
+	pager.Close()
+
+	pager, err = OpenPagerWith(memfs.Open, fp, COUNT)
+	if err != nil { t.Fatal(err) }
+	defer pager.Close()
+
+	pager.Prefetch(1, 2, 3, 4)
+	shard := pager.shardOf(1)
+	prefetched := map[uint64]int{}
+	shard.mu.Lock()
+	for pageId := uint64(1); pageId <= 4; pageId++ {
+		index, found := shard.frameMap[pageId]
+		assert.True(t, found, "prefetched page isn't resident")
+		assert.Zero(t, pager.frames[index].pins.Load(), "prefetch shouldn't pin")
+		prefetched[pageId] = index
+	}
+	shard.mu.Unlock()
+
+	// already resident, so nothing happens
+	pager.Prefetch(1, 2)
+
+	for pageId, index := range prefetched {
+		f := pager.GetPage(pageId)
+		assert.Equal(t, index, f.frameIndex)
+		assert.NoError(t, f.Wait())
+		assert.Equal(t, byte(pageId), f.data[c.PAGE_SIZE-1])
+		f.Release()
+	}
+
+	// with every frame pinned it's skipped, rather than waited for
+	var pinned []*Frame
+	for pageId := uint64(1); pageId <= COUNT; pageId++ {
+		pinned = append(pinned, pager.GetPage(pageId))
+	}
+	pager.Prefetch(COUNT + 1)
+	shard.mu.Lock()
+	_, found := shard.frameMap[COUNT + 1]
+	shard.mu.Unlock()
+	assert.False(t, found)
+	for _, f := range pinned {
+		assert.NoError(t, f.Wait())
+		f.MarkDirty(1)
+		f.Release()
+	}
+
+	// same when all there is to spare are dirty frames - writing those back is left to
+	// whoever needs a frame for real
+	pager.Prefetch(COUNT + 1)
+	shard.mu.Lock()
+	_, found = shard.frameMap[COUNT + 1]
+	shard.mu.Unlock()
+	assert.False(t, found)
+	for _, f := range pinned {
+		assert.True(t, f.Dirty())
+	}
+}
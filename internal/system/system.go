@@ -1,26 +1,111 @@
 // Platform abstracted filesystem ops
 package system
 
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Where DiskOps go. An op is handed over with Submit and completed asynchronously - Res is
+// set (bytes moved, or -errno) and then Ch is closed, just like IoMgr does it.
+type IoBackend interface {
+	Submit(op *DiskOp)
+	// Size of the file in bytes
+	Size() (uint64, error)
+	// Waits for everything already submitted to complete, then closes the file. Ops
+	// submitted afterwards complete straight away with -ECANCELED. Safe to call twice.
+	Close()
+	// nil while the backend works. Once it has broken down as a whole (not just failed an
+	// op), why - every op from then on fails straight away, and it stays that way.
+	Err() error
+}
+
+// Opens a backend on the file at path, creating it if create is set (otherwise it has to
+// exist already). slab is the pager's buffer memory, for backends that can make use of
+// knowing it up front.
+type Opener func(path string, create bool, slab []byte) (IoBackend, error)
+
+// Picks the backend with the MOOODB_IO environment variable:
+//   - "uring": io_uring (IoMgr), failing if that isn't available
+//   - "pool": pread/pwrite on a pool of goroutines (IoPool)
+//   - unset: io_uring, falling back to the pool if the ring or O_DIRECT can't be had (ie.
+//     seccomp or a filesystem that won't do direct I/O)
+func OpenDefault(path string, create bool, slab []byte) (IoBackend, error) {
+	switch os.Getenv("MOOODB_IO") {
+	case "uring":
+		return OpenUring(path, create, slab)
+	case "pool":
+		return OpenPool(path, create, slab)
+	}
+
+	backend, err := OpenUring(path, create, slab)
+	if err == nil { return backend, nil }
+	if os.IsNotExist(err) { return nil, err }
+
+	slog.Warn("io_uring backend unavailable, falling back to pread/pwrite pool", "err", err)
+	return OpenPool(path, create, slab)
+}
+
 // DiskOp is not owned my Iomgr
 type DiskOp struct {
 	opcode	OpCode
+	length 	uint32 // bytes to move - always a multiple of PAGE_SIZE
 
-	bufptr	uintptr // pointer to start of buf - len is implictly PAGE_SIZE
+	buf 	[]byte // for OpRead/OpWrite
 	offset	uint64 	// target file offset
 
 	Res		int32
 	Ch		chan struct{} // set by caller
 
-	_ [24]byte // pad to 128 bytes
+	iovecs 	[]syscall.Iovec // for OpReadv/OpWritev, has to outlive the op - so it lives here
+}
+
+// Completes op on the spot, without it going anywhere near the file
+func (op *DiskOp) complete(res int32) {
+	op.Res = res
+	close(op.Ch) // "broadcast"
 }
 
 // we can make this smaller if we need space, but we are padding now anyway
 type OpCode uint32
 const (
 	OpNop 	OpCode = iota
-	OpWrite 
+	OpWrite
 	OpRead
 	OpSync
 	OpAllocate
 	// OpTruncate
-)
\ No newline at end of file
+	OpWritev // scatter/gather over pages that sit next to each other in the file, but
+	OpReadv  // not in memory
+)
+
+// Sits in front of a backend's op queue, so Submit can't race Close into sending on a closed
+// channel. Submits hold it shared while they wait for room in the queue, Close takes it
+// exclusively to shut the queue.
+type opGate struct {
+	mu 		sync.RWMutex
+	closed 	bool
+}
+
+// Queues op, or cancels it if the gate is closed
+func (g *opGate) submit(queue chan *DiskOp, op *DiskOp) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.closed {
+		op.complete(-int32(syscall.ECANCELED))
+		return
+	}
+	queue <- op
+}
+
+// Closes queue, whoever is reading it drains what's left. False if it was closed already.
+func (g *opGate) close(queue chan *DiskOp) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed { return false }
+	g.closed = true
+	close(queue)
+	return true
+}
@@ -0,0 +1,363 @@
+package system
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"syscall"
+)
+
+var ErrCrashed = errors.New("system: simulated crash")
+
+// Size of a torn write is a multiple of this - what a disk writes atomically, at best
+const SECTOR_SIZE = 0x200
+
+// What a FaultBackend does to one OpWrite/OpWritev or OpSync
+type Fault int
+const (
+	FaultNone 		Fault = iota
+	FaultFail 		// completes with -EIO and has no effect
+	FaultDrop 		// reports success, but never happens (a lost write, or a lying fsync)
+	FaultTear 		// writes only - reports success, but only some leading sectors persist
+	FaultReorder 	// writes only - reports success, but isn't covered by the next sync, only
+					// the one after it (the disk reordered it past the barrier)
+	FaultShort 		// writes only - some leading sectors are written, and that's what it reports
+)
+
+// Which faults a FaultBackend injects, and when. Every OpWrite/OpWritev/OpSync submitted
+// gets the next sequence number (starting at 1), and either the fault At says for it, or
+// one picked at random with the given chances. Same seed and same ops, same faults.
+type FaultPlan struct {
+	Seed 	uint64
+	At 		map[uint64]Fault
+
+	Fail 	float64
+	Drop 	float64
+	Tear 	float64 // writes only
+	Reorder float64 // writes only
+	Short 	float64 // writes only
+
+	// Crash just before op CrashAt would happen (0 for never). If it's a sync, some of the
+	// writes it would have covered make it to disk anyway, in no particular order, maybe torn.
+	CrashAt uint64
+}
+
+// Wraps another backend (meant to be a MemFS one - writes go to the inner backend straight
+// from unaligned buffers) and simulates a disk with a volatile write cache in front of it.
+// Writes only land in the cache, reads see them there, and only a completed OpSync moves
+// them to the inner backend. Crash throws the cache away, like pulling the plug would - the
+// inner backend is left holding exactly what a disk would after a power loss, ready to be
+// reopened.
+//
+// On top of that it injects the faults in its FaultPlan. Ops are handled one at a time, in
+// the order they were submitted, and completed through DiskOp.Ch as usual.
+type FaultBackend struct {
+	inner 	IoBackend
+	plan 	FaultPlan
+	queue 	chan *DiskOp
+	gate 	opGate
+	done 	chan struct{}
+
+	mu 		sync.Mutex
+	rng 	*rand.Rand
+	seq 	uint64
+	cache 	[]cachedWrite // oldest first
+	crashed bool
+}
+
+// A write sitting in the volatile cache
+type cachedWrite struct {
+	offset 	uint64
+	data 	[]byte
+	persist int // how much of data will make it to disk - less than all of it if torn
+	barriers int // syncs it still has to sit out
+}
+
+func CreateFaultBackend(inner IoBackend, plan FaultPlan) *FaultBackend {
+	fb := &FaultBackend{
+		inner: 	inner,
+		plan: 	plan,
+		queue: 	make(chan *DiskOp, OP_Q_SIZE),
+		done: 	make(chan struct{}),
+		rng: 	rand.New(rand.NewPCG(plan.Seed, plan.Seed)),
+	}
+	go fb.worker()
+	return fb
+}
+
+// Opener that wraps whatever open gives out in a FaultBackend. opened (if not nil) is handed
+// each one, so the caller can Crash it.
+func FaultOpener(open Opener, plan FaultPlan, opened func(*FaultBackend)) Opener {
+	return func(path string, create bool, slab []byte) (IoBackend, error) {
+		inner, err := open(path, create, slab)
+		if err != nil { return nil, err }
+		fb := CreateFaultBackend(inner, plan)
+		if opened != nil { opened(fb) }
+		return fb, nil
+	}
+}
+
+func (fb *FaultBackend) Submit(op *DiskOp) {
+	fb.gate.submit(fb.queue, op)
+}
+
+// Size as far as anyone reading through us can tell, ie. including cached writes
+func (fb *FaultBackend) Size() (uint64, error) {
+	size, err := fb.inner.Size()
+	if err != nil { return 0, err }
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	for _, write := range fb.cache {
+		size = max(size, write.offset + uint64(len(write.data)))
+	}
+	return size, nil
+}
+
+// Finishes whatever was submitted, then closes the inner backend. Cached writes that were
+// never synced are lost, same as with Crash.
+func (fb *FaultBackend) Close() {
+	if !fb.gate.close(fb.queue) { return }
+	<- fb.done
+	fb.inner.Close()
+}
+
+// Pulls the plug - every write not covered by a completed OpSync is lost, and every op from
+// here on fails with EIO.
+func (fb *FaultBackend) Crash() {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.crash()
+}
+
+// ErrCrashed once crashed, otherwise whatever the inner backend says
+func (fb *FaultBackend) Err() error {
+	if fb.Crashed() { return ErrCrashed }
+	return fb.inner.Err()
+}
+
+func (fb *FaultBackend) Crashed() bool {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.crashed
+}
+
+// How many writes/syncs have been submitted so far, ie. the sequence number of the last one
+func (fb *FaultBackend) Ops() uint64 {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.seq
+}
+
+func (fb *FaultBackend) crash() {
+	fb.crashed = true
+	fb.cache = nil
+}
+
+func (fb *FaultBackend) worker() {
+	defer close(fb.done)
+	for op := range fb.queue {
+		op.Res = fb.do(op)
+		close(op.Ch) // "broadcast"
+	}
+}
+
+func (fb *FaultBackend) do(op *DiskOp) int32 {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if fb.crashed { return -int32(syscall.EIO) }
+
+	switch op.opcode {
+	case OpWrite, OpWritev:
+		fault := fb.next(true)
+		if fb.crashed { return -int32(syscall.EIO) }
+		return fb.write(op, fault)
+
+	case OpSync:
+		fault := fb.next(false)
+		if fb.crashed { return -int32(syscall.EIO) }
+		return fb.sync(fault)
+
+	case OpRead, OpReadv:
+		return fb.read(op)
+
+	default:
+		return fb.passthrough(op)
+	}
+}
+
+// Sequence number and fault for the next write or sync. Crashes (leaving crashed set) if
+// the plan says this is where it happens.
+func (fb *FaultBackend) next(write bool) Fault {
+	fb.seq++
+	if fb.seq == fb.plan.CrashAt {
+		if !write {
+			fb.persistSome()
+		}
+		fb.crash()
+		return FaultNone
+	}
+
+	if fault, found := fb.plan.At[fb.seq]; found { return fault }
+
+	r := fb.rng.Float64()
+	chances := []struct{ fault Fault; p float64 }{
+		{ FaultFail, fb.plan.Fail },
+		{ FaultDrop, fb.plan.Drop },
+	}
+	if write {
+		chances = append(chances,
+			struct{ fault Fault; p float64 }{ FaultTear, fb.plan.Tear },
+			struct{ fault Fault; p float64 }{ FaultReorder, fb.plan.Reorder },
+			struct{ fault Fault; p float64 }{ FaultShort, fb.plan.Short },
+		)
+	}
+	for _, chance := range chances {
+		if r < chance.p { return chance.fault }
+		r -= chance.p
+	}
+	return FaultNone
+}
+
+func (fb *FaultBackend) write(op *DiskOp, fault Fault) int32 {
+	switch fault {
+	case FaultFail:
+		return -int32(syscall.EIO)
+	case FaultDrop:
+		return int32(op.length)
+	}
+
+	data := make([]byte, 0, op.length)
+	if op.opcode == OpWrite {
+		data = append(data, op.buf...)
+	} else {
+		for _, iov := range op.iovecs {
+			data = append(data, iovecBytes(iov)...)
+		}
+	}
+
+	write := cachedWrite{ offset: op.offset, data: data, persist: len(data) }
+	switch fault {
+	case FaultTear:
+		write.persist = fb.tear(len(data))
+	case FaultReorder:
+		write.barriers = 1
+	case FaultShort:
+		write.data = data[:fb.tear(len(data))]
+		write.persist = len(write.data)
+	}
+	fb.cache = append(fb.cache, write)
+	return int32(len(write.data))
+}
+
+// A random number of whole sectors short of all of them
+func (fb *FaultBackend) tear(length int) int {
+	return fb.rng.IntN(length / SECTOR_SIZE) * SECTOR_SIZE
+}
+
+// Moves every write the sync covers to the inner backend, and syncs that.
+func (fb *FaultBackend) sync(fault Fault) int32 {
+	switch fault {
+	case FaultFail:
+		return -int32(syscall.EIO)
+	case FaultDrop:
+		return 0
+	}
+
+	var held []cachedWrite
+	for _, write := range fb.cache {
+		if write.barriers > 0 {
+			write.barriers--
+			held = append(held, write)
+			continue
+		}
+		if res := fb.persist(write); res < 0 { return res }
+	}
+	fb.cache = held
+
+	var op DiskOp
+	op.PrepareOpSlice(OpSync, nil, 0)
+	return fb.run(&op)
+}
+
+// For a crash in the middle of a sync - some of the cached writes made it, in whatever
+// order the disk felt like, and maybe not all of each.
+func (fb *FaultBackend) persistSome() {
+	for _, i := range fb.rng.Perm(len(fb.cache)) {
+		write := fb.cache[i]
+		switch fb.rng.IntN(3) {
+		case 0:
+			continue
+		case 1:
+			write.persist = min(write.persist, fb.tear(len(write.data)))
+		}
+		fb.persist(write)
+	}
+}
+
+func (fb *FaultBackend) persist(write cachedWrite) int32 {
+	if write.persist == 0 { return 0 }
+	var op DiskOp
+	op.prepareRaw(OpWrite, write.data[:write.persist], write.offset)
+	return fb.run(&op)
+}
+
+// Reads from the inner backend, with whatever is in the cache on top
+func (fb *FaultBackend) read(op *DiskOp) int32 {
+	var bufs [][]byte
+	if op.opcode == OpRead {
+		bufs = [][]byte{op.buf}
+	} else {
+		for _, iov := range op.iovecs {
+			bufs = append(bufs, iovecBytes(iov))
+		}
+	}
+
+	res := int64(0)
+	offset := op.offset
+	for _, buf := range bufs {
+		var inner DiskOp
+		inner.prepareRaw(OpRead, buf, offset)
+		n := fb.run(&inner)
+		if n < 0 { return n }
+
+		// the cache can reach further than the file does
+		end := int64(n)
+		for _, write := range fb.cache {
+			lo := max(write.offset, offset)
+			hi := min(write.offset + uint64(len(write.data)), offset + uint64(len(buf)))
+			if lo >= hi { continue }
+			copy(buf[lo - offset:hi - offset], write.data[lo - write.offset:])
+			end = max(end, int64(hi - offset))
+		}
+
+		res += end
+		offset += uint64(len(buf))
+		if end < int64(len(buf)) { break }
+	}
+	return int32(res)
+}
+
+func (fb *FaultBackend) passthrough(op *DiskOp) int32 {
+	inner := *op
+	inner.Ch = make(chan struct{})
+	return fb.run(&inner)
+}
+
+// Like PrepareOpSlice, but for any length - only backends that don't care about alignment
+// (ie. MemFS) can take these.
+func (op *DiskOp) prepareRaw(opcode OpCode, buf []byte, offset uint64) {
+	op.opcode = opcode
+	op.length = uint32(len(buf))
+	op.buf = buf
+	op.offset = offset
+	op.iovecs = nil
+	op.Ch = make(chan struct{})
+}
+
+// Hands op to the inner backend and waits it out
+func (fb *FaultBackend) run(op *DiskOp) int32 {
+	fb.inner.Submit(op)
+	<- op.Ch
+	return op.Res
+}
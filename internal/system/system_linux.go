@@ -5,7 +5,11 @@ import (
 	"mooodb/internal/util"
 	"sync/atomic"
 
+	"errors"
+	"fmt"
 	"log/slog"
+	"os"
+	"syscall"
 	"unsafe"
 
 	"github.com/aethne0/giouring"
@@ -13,10 +17,7 @@ import (
 )
 
 // PERF:
-// 1. read/write fixed
-// 2. register buffer
-// 3. register file
-// 4. huge TLB
+// 1. huge TLB
 
 const MMAP_MODE   	= unix.MAP_ANON  | unix.MAP_PRIVATE
 const MMAP_PROT   	= unix.PROT_READ | unix.PROT_WRITE
@@ -33,6 +34,9 @@ const RING_TARG_DPTH	= 0x60
 // So that as long as we have inflight+queued <= RING_TARG_DPTH we can safely 
 // take an OpBatch out of the worker submission queue
 
+// Longest buffer io_uring will register in one go - bigger slabs are split into several
+const FIXED_BUF_MAX		= 1 << 30
+
 // For fixed/aligned buffers - not for io_uring itself, liburing handles mmap-ing for 
 // io_uring setup. This allocation will be aligned to the system page size (check using:
 // `getconf PAGESIZE`. This will basically always be 0x1000 (4096))
@@ -58,47 +62,224 @@ func DeallocAlignedSlab(ptr []byte) error {
 	return err
 }
 
+// Opens the data file for IoPool - with O_DIRECT if the filesystem takes it, buffered if it
+// doesn't.
+func openDataFile(path string, create bool) (*os.File, error) {
+	mode := F_OPEN_MODE
+	if !create { mode &^= unix.O_CREAT }
+
+	file, err := os.OpenFile(path, mode, F_OPEN_PERM)
+	if errors.Is(err, unix.EINVAL) {
+		slog.Warn("O_DIRECT not supported here, using buffered I/O", "path", path)
+		file, err = os.OpenFile(path, mode &^ unix.O_DIRECT, F_OPEN_PERM)
+	}
+	return file, err
+}
+
+// Bytes an iovec points at
+func iovecBytes(iov syscall.Iovec) []byte {
+	return unsafe.Slice(iov.Base, iov.Len)
+}
+
 type IoMgr struct {
 	log			slog.Logger
 	ring 		*giouring.Ring
-	OpQueue		chan *DiskOp
+	opQueue		chan *DiskOp
+	gate 		opGate
+	done 		chan struct{} // closed once ringlord has drained everything and returned
+	failed 		atomic.Int32 // 0 until the ring fails, then the -errno every op gets
+	failure 	error // why the ring failed, set before failed is
 	fd			int
 	opPtrs 		util.TicketQueue[*DiskOp]
+
+	fixedFile 	bool // fd is registered with the ring, as fixed file 0
+	fixedBufs 	[]fixedBuf // registered buffers, by buffer index
+}
+
+// Memory range of a registered buffer
+type fixedBuf struct {
+	start 	uintptr
+	end 	uintptr
 }
 
 func CreateIoMgr(path string) (*IoMgr ,error) {
+	return CreateIoMgrFixed(path, nil)
+}
+
+// Like CreateIoMgr, but registers slab (from AllocAlignedSlab) with the ring so reads and
+// writes into it skip pinning and mapping the pages on every op. The file is registered as
+// well, so the kernel doesn't have to look up the fd every time either.
+//
+// Registered buffers count against RLIMIT_MEMLOCK - if that is too low (check `ulimit -l`),
+// or registering fails for any other reason, we carry on without and log a warning. Ops on
+// memory outside of the slab work the same either way.
+func CreateIoMgrFixed(path string, slab []byte) (*IoMgr ,error) {
+	return createIoMgr(path, F_OPEN_MODE, slab)
+}
+
+// Opener for IoMgr
+func OpenUring(path string, create bool, slab []byte) (IoBackend, error) {
+	mode := F_OPEN_MODE
+	if !create { mode &^= unix.O_CREAT }
+	return createIoMgr(path, mode, slab)
+}
+
+func createIoMgr(path string, mode int, slab []byte) (*IoMgr ,error) {
 	log := *slog.With("src", "IoMgr")
 
-	fd, err := unix.Open(path, F_OPEN_MODE, F_OPEN_PERM)
-	if err != nil { return nil, err }
+	fd, err := unix.Open(path, mode, F_OPEN_PERM)
+	if err != nil { return nil, &os.PathError{ Op: "open", Path: path, Err: err } }
 
 	ring, err := giouring.CreateRing(RING_ENTRIES)
-	if err != nil { return nil, err }
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
 
 	iomgr := IoMgr {
 		log: 		log,
 		ring: 		ring,
-		OpQueue: 	make(chan *DiskOp, OP_Q_SIZE),
+		opQueue: 	make(chan *DiskOp, OP_Q_SIZE),
+		done: 		make(chan struct{}),
 		fd:			fd,
 		opPtrs: 	util.CreateTicketQueue[*DiskOp](RING_ENTRIES),
 	}
 
+	iomgr.registerFile()
+	if len(slab) > 0 {
+		iomgr.registerSlab(slab)
+	}
+
 	go iomgr.ringlord()
 	return &iomgr, nil
 }
 
+// Ops submitted after the ring has failed complete straight away, with the same error as
+// everything else it failed.
+func (m *IoMgr) Submit(op *DiskOp) {
+	if res := m.failed.Load(); res != 0 {
+		op.complete(res)
+		return
+	}
+	m.gate.submit(m.opQueue, op)
+}
+
+// Why the ring failed, if it has
+func (m *IoMgr) Err() error {
+	if m.failed.Load() == 0 { return nil }
+	return m.failure
+}
+
+func (m *IoMgr) Size() (uint64, error) {
+	var stat unix.Stat_t
+	if err := unix.Fstat(m.fd, &stat); err != nil { return 0, err }
+	return uint64(stat.Size), nil
+}
+
+// Whether the file and the slab ended up registered
+func (m *IoMgr) Fixed() (file bool, bufs bool) {
+	return m.fixedFile, len(m.fixedBufs) > 0
+}
+
+func (m *IoMgr) register(opcode uint32, arg unsafe.Pointer, nrArgs int) error {
+	_, errno := m.ring.Register(m.ring.RingFd(), opcode, arg, uint32(nrArgs))
+	if errno != 0 { return errno }
+	return nil
+}
+
+func (m *IoMgr) registerFile() {
+	files := []int32{int32(m.fd)}
+	if err := m.register(giouring.RegisterFiles, unsafe.Pointer(&files[0]), len(files)); err != nil {
+		m.log.Warn("Couldn't register file, using plain fd", "err", err)
+		return
+	}
+	m.fixedFile = true
+}
+
+func (m *IoMgr) registerSlab(slab []byte) {
+	var iovecs []syscall.Iovec
+	var bufs []fixedBuf
+	for start := 0; start < len(slab); start += FIXED_BUF_MAX {
+		chunk := slab[start:min(start + FIXED_BUF_MAX, len(slab))]
+		var iov syscall.Iovec
+		iov.Base = &chunk[0]
+		iov.SetLen(len(chunk))
+		iovecs = append(iovecs, iov)
+
+		ptr := uintptr(unsafe.Pointer(&chunk[0]))
+		bufs = append(bufs, fixedBuf{ start: ptr, end: ptr + uintptr(len(chunk)) })
+	}
+
+	err := m.register(giouring.RegisterBuffers, unsafe.Pointer(&iovecs[0]), len(iovecs))
+	if err != nil {
+		var lim unix.Rlimit
+		unix.Getrlimit(unix.RLIMIT_MEMLOCK, &lim)
+		m.log.Warn("Couldn't register buffers, falling back to plain reads/writes",
+			"err", err, "slab-size", len(slab), "memlock-limit", lim.Cur,
+		)
+		return
+	}
+	m.fixedBufs = bufs
+}
+
+// Index of the registered buffer that holds all of [ptr, ptr+length), if any
+func (m *IoMgr) fixedIndex(ptr uintptr, length uint32) (int, bool) {
+	for i, buf := range m.fixedBufs {
+		if ptr >= buf.start && ptr + uintptr(length) <= buf.end {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Stops taking ops and waits for ringlord to complete everything it already has, then tears
+// down the ring and closes the file.
 func (m *IoMgr) Close() {
+	if !m.gate.close(m.opQueue) { return }
+	<- m.done
 	m.ring.QueueExit()
+	if err := unix.Close(m.fd); err != nil {
+		m.log.Error("Close", "err", err)
+	}
 }
 
 // This simply populates the DiskOp struct that you already have+own, there is 
 // no channel-stuff/blocking that can happen.
 // This allocates a fresh channel as well.
 func (op *DiskOp) PrepareOpSlice(opcode OpCode, slice []byte, offset uint64) {
+	op.PrepareOpExtent(opcode, slice, 1, offset)
+}
+
+// Like PrepareOpSlice, but for a run of pages that are contiguous both in slice and in the
+// file, moved with a single SQE.
+func (op *DiskOp) PrepareOpExtent(opcode OpCode, slice []byte, pages int, offset uint64) {
 	op.opcode = opcode
+	op.length = uint32(pages * c.PAGE_SIZE)
+	op.offset = offset
+	op.buf = nil
+	op.iovecs = op.iovecs[:0]
 	if opcode == OpWrite || opcode == OpRead {
-		op.bufptr = uintptr(unsafe.Pointer(&slice[0]))
-		op.offset = offset
+		op.buf = slice[:op.length]
+	}
+	op.Ch = make(chan struct{})
+}
+
+// For OpReadv/OpWritev - every buf is a whole number of pages, and they go to (or come from)
+// the file back to back starting at offset. Res is the total number of bytes moved.
+//
+// The iovec array is kept in the op and reused the next time round.
+func (op *DiskOp) PrepareOpVec(opcode OpCode, bufs [][]byte, offset uint64) {
+	op.opcode = opcode
+	op.offset = offset
+	op.length = 0
+	op.buf = nil
+	op.iovecs = op.iovecs[:0]
+	for _, buf := range bufs {
+		var iov syscall.Iovec
+		iov.Base = &buf[0]
+		iov.SetLen(len(buf))
+		op.iovecs = append(op.iovecs, iov)
+		op.length += uint32(len(buf))
 	}
 	op.Ch = make(chan struct{})
 }
@@ -113,21 +294,43 @@ func (m *IoMgr) prepSQEs(op *DiskOp) {
 		sqe.PrepareNop()
 
 	case OpWrite:
-		sqe.PrepareWrite(m.fd, op.bufptr, c.PAGE_SIZE, op.offset)
+		bufptr := uintptr(unsafe.Pointer(&op.buf[0]))
+		if index, ok := m.fixedIndex(bufptr, op.length); ok {
+			sqe.PrepareWriteFixed(m.fd, bufptr, op.length, op.offset, index)
+		} else {
+			sqe.PrepareWrite(m.fd, bufptr, op.length, op.offset)
+		}
 
 	case OpRead:
-		sqe.PrepareRead(m.fd, op.bufptr, c.PAGE_SIZE, op.offset)
+		bufptr := uintptr(unsafe.Pointer(&op.buf[0]))
+		if index, ok := m.fixedIndex(bufptr, op.length); ok {
+			sqe.PrepareReadFixed(m.fd, bufptr, op.length, op.offset, index)
+		} else {
+			sqe.PrepareRead(m.fd, bufptr, op.length, op.offset)
+		}
+
+	case OpWritev:
+		sqe.PrepareWritev(m.fd, uintptr(unsafe.Pointer(&op.iovecs[0])), uint32(len(op.iovecs)), op.offset)
+
+	case OpReadv:
+		sqe.PrepareReadv(m.fd, uintptr(unsafe.Pointer(&op.iovecs[0])), uint32(len(op.iovecs)), op.offset)
 
 	case OpSync:
 		sqe.PrepareFsync(m.fd, 0)
 
 	case OpAllocate:
-		sqe.PrepareFallocate(m.fd, 0, op.offset, uint64(c.PAGE_SIZE))
+		sqe.PrepareFallocate(m.fd, 0, op.offset, uint64(op.length))
 
 	default:
 		panic("Unknown opcode submitted to IoMgr")
 	}
 
+	// index into the registered files instead of the fd
+	if m.fixedFile && op.opcode != OpNop {
+		sqe.Fd = 0
+		sqe.Flags |= giouring.SqeFixedFile
+	}
+
 	opTicket := m.opPtrs.Acq(op)
 	sqe.UserData = uint64(opTicket)
 }
@@ -135,6 +338,36 @@ func (m *IoMgr) prepSQEs(op *DiskOp) {
 // "Those who sow the good seed
 // Shall surely reap"
 func (m *IoMgr) ringlord() {
+	defer close(m.done)
+	err := m.loop()
+	if err == nil { return }
+
+	m.fail(err)
+	// whatever got queued before Submit could tell, until Close shuts the queue
+	for op := range m.opQueue {
+		op.complete(m.failed.Load())
+	}
+}
+
+// Puts the manager in the failed state, and fails every op it was holding - prepared or in
+// flight. The kernel might still be working on the ones in flight, but we can't reap them
+// anymore, so nobody would ever hear back otherwise.
+func (m *IoMgr) fail(err error) {
+	m.log.Error("io_uring failed, failing every op from here on", "err", err)
+
+	errno := syscall.EIO
+	errors.As(err, &errno)
+	m.failure = err
+	m.failed.Store(-int32(errno))
+
+	m.opPtrs.Held(func(ticket int, op *DiskOp) {
+		op.complete(-int32(errno))
+		m.opPtrs.Rel(ticket)
+	})
+}
+
+// Runs the ring until Close, or until it fails
+func (m *IoMgr) loop() error {
 	// note: it is possible to set interrupt affinity so io_uring io interupts will come 
 	// 		 to this core
 	/*
@@ -149,6 +382,7 @@ func (m *IoMgr) ringlord() {
 
 	var queued   uint = 0 // SQEs that we have "got" and prepared from the opQueue
 	var inflight uint = 0 // SQEs that have been SUBMITTED
+	open := true // until Close shuts the opQueue, then we finish up what we have and return
 
 	// This is our main io_uring manager loop. It is split into three phases:
 	// 1. We collect submitted ops from our worker-facing opQueue, and get+prepare SQEs
@@ -156,22 +390,27 @@ func (m *IoMgr) ringlord() {
 	// 3. We reap completed CQEs
 	// This part is a bit magical
 	// you have to decide how to tradeoff latency vs. throughput vs. cpu usage
-	for {
+	for open || queued > 0 || inflight > 0 {
 		// STAGE 1
 		if inflight == 0 && queued == 0 {
 			// If we dont have any inflight ops, then theres no CQEs to reap and we
 			// should just block on the opQueue until we have at least 1 op to submit
 			// This code only takes 1, then the COLLECT loop will greedily and non-blockingly
 			// take the rest (if any)
-			op := <- m.OpQueue
+			op, ok := <- m.opQueue
+			if !ok { return nil }
 			m.prepSQEs(op)
 			queued++
 		} 
 
 		// Non-blocking - check for new submissions
-		COLLECT: for inflight + queued < RING_ENTRIES {
+		COLLECT: for open && inflight + queued < RING_ENTRIES {
 			select {
-			case op := <- m.OpQueue:
+			case op, ok := <- m.opQueue:
+				if !ok {
+					open = false
+					break COLLECT
+				}
 				m.prepSQEs(op)
 				queued++
 			default:
@@ -181,29 +420,40 @@ func (m *IoMgr) ringlord() {
 
 		// STAGE 2
 		if queued > 0 {
-			var submitted uint
 			var err error
 			// If we have a deep queue we will wait for some completions - can change later
 			if inflight + queued > RING_TARG_DPTH { 
-				submitted, err = m.ring.SubmitAndWait(8)
+				_, err = m.ring.SubmitAndWait(8)
 			} else {
-				submitted, err = m.ring.Submit()
+				_, err = m.ring.Submit()
+			}
+			switch err {
+			case nil, unix.ETIME, unix.EINTR:
+			case unix.EAGAIN, unix.EBUSY:
+				// the kernel is short on memory, or the CQ is full - reap, then try again
+			default:
+				return fmt.Errorf("io_uring submit: %w", err)
 			}
-			if err != nil && err != unix.ETIME && err != unix.EINTR {
-				// should do something here
-				m.log.Error("Submit", "err", err)
-			} 
+			// whatever the kernel hasn't consumed is still queued - on an error we can't go
+			// by what Submit returned, and that may well be all of it
+			submitted := queued - uint(m.ring.SQReady())
 			queued   -= submitted
 			inflight += submitted
 		}
 
 		for inflight > 0 {		
-			cqe, err := m.ring.PeekCQE()
+			// once closing there's nothing else to do, so we might as well sleep on it
+			var cqe *giouring.CompletionQueueEvent
+			var err error
+			if open || queued > 0 {
+				cqe, err = m.ring.PeekCQE()
+			} else {
+				cqe, err = m.ring.WaitCQE()
+			}
 			if err == unix.EAGAIN || err == unix.EINTR || err == unix.ETIME {
 				break
 			} else if err != nil {
-				m.log.Error("Peek cqe fatal error", "err", err)
-				panic("Something wrong with your IO_URING!")
+				return fmt.Errorf("io_uring peek cqe: %w", err)
 			}
 
 			if cqe == nil { 
@@ -230,5 +480,5 @@ func (m *IoMgr) ringlord() {
 			m.ring.CQESeen(cqe)
 		}
 	}
+	return nil
 }
-
@@ -0,0 +1,170 @@
+package system
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Workers in an IoPool - each one has at most one op in flight
+const POOL_WORKERS = 16
+
+// Plain pread/pwrite/fdatasync on a pool of goroutines, for when io_uring isn't around (ie.
+// seccomp'd containers). Completes ops the same way IoMgr does, so the pager can't tell the
+// difference, it's just slower. Uses O_DIRECT when the filesystem lets us.
+type IoPool struct {
+	log 	slog.Logger
+	file 	poolFile
+	queue 	chan *DiskOp
+	gate 	opGate
+	wg 		sync.WaitGroup
+}
+
+// What an IoPool runs its ops against - a real file, or a MemFile
+type poolFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Truncate(size int64) error
+	Size() (uint64, error)
+	Close() error
+}
+
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Size() (uint64, error) {
+	info, err := f.Stat()
+	if err != nil { return 0, err }
+	return uint64(info.Size()), nil
+}
+
+// fdatasync, not the full fsync os.File does - the size still makes it to disk, just not
+// the timestamps
+func (f osFile) Sync() error {
+	return unix.Fdatasync(int(f.Fd()))
+}
+
+func CreateIoPool(path string, create bool, workers int) (*IoPool, error) {
+	file, err := openDataFile(path, create)
+	if err != nil { return nil, err }
+	return newIoPool(osFile{file}, workers), nil
+}
+
+func newIoPool(file poolFile, workers int) *IoPool {
+	pool := &IoPool{
+		log: 	*slog.With("src", "IoPool"),
+		file: 	file,
+		queue: 	make(chan *DiskOp, OP_Q_SIZE),
+	}
+	for range workers {
+		pool.wg.Add(1)
+		go pool.worker()
+	}
+	return pool
+}
+
+// Opener for IoPool
+func OpenPool(path string, create bool, _ []byte) (IoBackend, error) {
+	return CreateIoPool(path, create, POOL_WORKERS)
+}
+
+func (p *IoPool) Submit(op *DiskOp) {
+	p.gate.submit(p.queue, op)
+}
+
+func (p *IoPool) Size() (uint64, error) {
+	return p.file.Size()
+}
+
+// Always nil - every op is a syscall of its own, so errors never outlive the op
+func (p *IoPool) Err() error {
+	return nil
+}
+
+// Waits for every op already submitted to finish, then closes the file
+func (p *IoPool) Close() {
+	if !p.gate.close(p.queue) { return }
+	p.wg.Wait()
+	if err := p.file.Close(); err != nil {
+		p.log.Error("Close", "err", err)
+	}
+}
+
+func (p *IoPool) worker() {
+	defer p.wg.Done()
+	for op := range p.queue {
+		op.Res = p.do(op)
+		close(op.Ch) // "broadcast"
+	}
+}
+
+func (p *IoPool) do(op *DiskOp) int32 {
+	if int64(op.offset) < 0 {
+		// os.File would make up its own error for this, the kernel says EINVAL
+		return -int32(syscall.EINVAL)
+	}
+
+	switch op.opcode {
+	case OpNop:
+		return 0
+
+	case OpWrite:
+		return opRes(p.file.WriteAt(op.buf, int64(op.offset)))
+
+	case OpRead:
+		return opRes(p.file.ReadAt(op.buf, int64(op.offset)))
+
+	case OpWritev, OpReadv:
+		total := 0
+		offset := int64(op.offset)
+		for _, iov := range op.iovecs {
+			buf := iovecBytes(iov)
+			var n int
+			var err error
+			if op.opcode == OpWritev {
+				n, err = p.file.WriteAt(buf, offset)
+			} else {
+				n, err = p.file.ReadAt(buf, offset)
+			}
+			total += n
+			offset += int64(n)
+			if err != nil || n < len(buf) {
+				// like readv/writev - whatever made it counts, unless nothing did
+				if res := opRes(n, err); res < 0 && total == 0 { return res }
+				break
+			}
+		}
+		return int32(total)
+
+	case OpSync:
+		return opRes(0, p.file.Sync())
+
+	case OpAllocate:
+		// no fallocate here, growing the file is as close as we get
+		size, err := p.file.Size()
+		if err != nil { return opRes(0, err) }
+		if end := int64(op.offset) + int64(op.length); int64(size) < end {
+			return opRes(0, p.file.Truncate(end))
+		}
+		return 0
+
+	default:
+		panic("Unknown opcode submitted to IoPool")
+	}
+}
+
+// DiskOp.Res for n bytes moved and err. Reads past the end of the file come up short rather
+// than failing, same as pread.
+func opRes(n int, err error) int32 {
+	if err == nil || err == io.EOF { return int32(n) }
+	var errno syscall.Errno
+	if errors.As(err, &errno) { return -int32(errno) }
+	return -int32(syscall.EIO)
+}
@@ -11,6 +11,7 @@ import (
 	"runtime"
 	"slices"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 	"unsafe"
@@ -130,7 +131,7 @@ func Test_Iomgr_Multi_Worker_Drifting(t *testing.T) {
 				op.PrepareOpSlice(OpWrite, slab[opBase:], uint64(opBase))
 				// we need to allocate the channel, that is our job
 				// This actually submits the DiskOp
-				iomgr.OpQueue <- op
+				iomgr.Submit(op)
 				<- op.Ch
 			}
 
@@ -149,7 +150,7 @@ func Test_Iomgr_Multi_Worker_Drifting(t *testing.T) {
 			for opi := range OPS_PER_WORKER {
 				opBase := workerBase + (c.PAGE_SIZE * uintptr(opi))
 				op.PrepareOpSlice(OpRead, slab[opBase+BUFSIZE:], uint64(opBase))
-				iomgr.OpQueue <- op
+				iomgr.Submit(op)
 				<- op.Ch
 			}
 
@@ -169,3 +170,378 @@ func Test_Iomgr_Multi_Worker_Drifting(t *testing.T) {
 		)
 	}
 }
+
+func Test_Iomgr_Extent_And_Vectored(t *testing.T) {
+	const PAGES = 8
+	const BUFSIZE = c.PAGE_SIZE * PAGES
+	slab, err := AllocAlignedSlab(BUFSIZE * 2)
+	if err != nil { t.Fatal(err) }
+	defer DeallocAlignedSlab(slab)
+
+	iomgr, err := CreateIoMgr(tempfile(t))
+	if err != nil { t.Fatal(err) }
+	defer iomgr.Close()
+
+	fillRandFast(slab[:BUFSIZE])
+
+	// one SQE for the whole run
+	var op DiskOp
+	op.PrepareOpExtent(OpWrite, slab, PAGES, 0)
+	iomgr.Submit(&op)
+	<- op.Ch
+	if op.Res != BUFSIZE { t.Fatal("extent write", op.Res) }
+
+	// read it back into pages scattered around the other half of the slab, back to front
+	dst := slab[BUFSIZE:]
+	bufs := make([][]byte, PAGES)
+	for i := range bufs {
+		at := (PAGES - 1 - i) * c.PAGE_SIZE
+		bufs[i] = dst[at:at + c.PAGE_SIZE]
+	}
+	op.PrepareOpVec(OpReadv, bufs, 0)
+	iomgr.Submit(&op)
+	<- op.Ch
+	if op.Res != BUFSIZE { t.Fatal("readv", op.Res) }
+
+	for i, buf := range bufs {
+		if !slices.Equal(slab[i*c.PAGE_SIZE:(i+1)*c.PAGE_SIZE], buf) {
+			t.Fatal("readv page didn't match", i)
+		}
+	}
+
+	// and writev them back out one page further along
+	op.PrepareOpVec(OpWritev, bufs, c.PAGE_SIZE)
+	iomgr.Submit(&op)
+	<- op.Ch
+	if op.Res != BUFSIZE { t.Fatal("writev", op.Res) }
+
+	op.PrepareOpExtent(OpRead, dst, PAGES, c.PAGE_SIZE)
+	iomgr.Submit(&op)
+	<- op.Ch
+	if op.Res != BUFSIZE { t.Fatal("extent read", op.Res) }
+	if !slices.Equal(slab[:BUFSIZE], dst) {
+		t.Fatal("read-back data didnt match")
+	}
+}
+
+func Test_Iomgr_Fixed(t *testing.T) {
+	const PAGES = 4
+	slab, err := AllocAlignedSlab(c.PAGE_SIZE * PAGES * 2)
+	if err != nil { t.Fatal(err) }
+	defer DeallocAlignedSlab(slab)
+
+	iomgr, err := CreateIoMgrFixed(tempfile(t), slab[:c.PAGE_SIZE * PAGES])
+	if err != nil { t.Fatal(err) }
+	defer iomgr.Close()
+
+	file, bufs := iomgr.Fixed()
+	t.Log("fixed file", file, "fixed buffers", bufs)
+	if !bufs {
+		var lim unix.Rlimit
+		unix.Getrlimit(unix.RLIMIT_MEMLOCK, &lim)
+		t.Log("buffers weren't registered, memlock limit", lim.Cur)
+	}
+
+	// half in the registered slab, half outside of it - both have to work
+	fillRandFast(slab[:c.PAGE_SIZE * PAGES])
+	want := slices.Clone(slab[:c.PAGE_SIZE * PAGES])
+	var op DiskOp
+	for i := range PAGES {
+		op.PrepareOpSlice(OpWrite, slab[i*c.PAGE_SIZE:], uint64(i*c.PAGE_SIZE))
+		iomgr.Submit(&op)
+		<- op.Ch
+		if op.Res != c.PAGE_SIZE { t.Fatal("write", op.Res) }
+	}
+
+	op.PrepareOpExtent(OpRead, slab[c.PAGE_SIZE * PAGES:], PAGES, 0)
+	iomgr.Submit(&op)
+	<- op.Ch
+	if op.Res != c.PAGE_SIZE * PAGES { t.Fatal("read", op.Res) }
+	if !slices.Equal(want, slab[c.PAGE_SIZE * PAGES:]) {
+		t.Fatal("read-back data didnt match")
+	}
+
+	// straddles the end of the registered buffer, so not fixed
+	op.PrepareOpExtent(OpRead, slab[c.PAGE_SIZE * (PAGES-1):], 2, 0)
+	iomgr.Submit(&op)
+	<- op.Ch
+	if op.Res != c.PAGE_SIZE * 2 { t.Fatal("straddling read", op.Res) }
+	if !slices.Equal(want[:c.PAGE_SIZE * 2], slab[c.PAGE_SIZE * (PAGES-1):c.PAGE_SIZE * (PAGES+1)]) {
+		t.Fatal("straddling read-back data didnt match")
+	}
+
+	op.PrepareOpSlice(OpSync, nil, 0)
+	iomgr.Submit(&op)
+	<- op.Ch
+	if op.Res < 0 { t.Fatal("sync", op.Res) }
+}
+
+func Test_IoPool(t *testing.T) {
+	const PAGES = 4
+	const BUFSIZE = c.PAGE_SIZE * PAGES
+	slab, err := AllocAlignedSlab(BUFSIZE * 2)
+	if err != nil { t.Fatal(err) }
+	defer DeallocAlignedSlab(slab)
+
+	fp := tempfile(t)
+	_, err = OpenPool(fp, false, nil)
+	if !os.IsNotExist(err) { t.Fatal("opened a file that isn't there", err) }
+
+	var pool IoBackend
+	pool, err = OpenPool(fp, true, slab)
+	if err != nil { t.Fatal(err) }
+	defer pool.Close()
+
+	fillRandFast(slab[:BUFSIZE])
+
+	var op DiskOp
+	op.PrepareOpExtent(OpWrite, slab, PAGES, 0)
+	pool.Submit(&op)
+	<- op.Ch
+	if op.Res != BUFSIZE { t.Fatal("write", op.Res) }
+
+	op.PrepareOpSlice(OpSync, nil, 0)
+	pool.Submit(&op)
+	<- op.Ch
+	if op.Res < 0 { t.Fatal("sync", op.Res) }
+
+	dst := slab[BUFSIZE:]
+	bufs := make([][]byte, PAGES)
+	for i := range bufs {
+		bufs[i] = dst[i*c.PAGE_SIZE:(i+1)*c.PAGE_SIZE]
+	}
+	op.PrepareOpVec(OpReadv, bufs, 0)
+	pool.Submit(&op)
+	<- op.Ch
+	if op.Res != BUFSIZE { t.Fatal("readv", op.Res) }
+	if !slices.Equal(slab[:BUFSIZE], dst) { t.Fatal("read-back data didnt match") }
+
+	// past the end of the file is a short read, not an error
+	op.PrepareOpSlice(OpRead, dst, BUFSIZE)
+	pool.Submit(&op)
+	<- op.Ch
+	if op.Res != 0 { t.Fatal("read past end", op.Res) }
+
+	op.PrepareOpSlice(OpAllocate, nil, BUFSIZE)
+	pool.Submit(&op)
+	<- op.Ch
+	if op.Res < 0 { t.Fatal("allocate", op.Res) }
+	if size, err := pool.Size(); err != nil || size != BUFSIZE + c.PAGE_SIZE {
+		t.Fatal("size after allocate", size, err)
+	}
+}
+
+func Test_MemFS(t *testing.T) {
+	fs := NewMemFS()
+	_, err := fs.Open("a.moo", false, nil)
+	if !os.IsNotExist(err) { t.Fatal("opened a file that isn't there", err) }
+
+	backend, err := fs.Open("a.moo", true, nil)
+	if err != nil { t.Fatal(err) }
+
+	// queued up without waiting, they still complete in order
+	const PAGES = 8
+	src := make([]byte, c.PAGE_SIZE * PAGES)
+	fillRandFast(src)
+	ops := make([]DiskOp, PAGES)
+	for i := range ops {
+		ops[i].PrepareOpSlice(OpWrite, src[i*c.PAGE_SIZE:], uint64(i*c.PAGE_SIZE))
+		backend.Submit(&ops[i])
+	}
+	for i := range ops {
+		<- ops[i].Ch
+		if ops[i].Res != c.PAGE_SIZE { t.Fatal("write", i, ops[i].Res) }
+	}
+	backend.Close()
+
+	if !slices.Equal(src, fs.File("a.moo").Bytes()) { t.Fatal("file doesn't hold what was written") }
+
+	// outlives the backend
+	backend, err = fs.Open("a.moo", false, nil)
+	if err != nil { t.Fatal(err) }
+	defer backend.Close()
+	if size, _ := backend.Size(); size != uint64(len(src)) { t.Fatal("size", size) }
+
+	dst := make([]byte, c.PAGE_SIZE * PAGES)
+	var op DiskOp
+	op.PrepareOpExtent(OpRead, dst, PAGES, 0)
+	backend.Submit(&op)
+	<- op.Ch
+	if op.Res != int32(len(dst)) || !slices.Equal(src, dst) { t.Fatal("read-back data didnt match") }
+}
+
+func Test_FaultBackend(t *testing.T) {
+	fs := NewMemFS()
+	var fb *FaultBackend
+	plan := FaultPlan{
+		Seed: 1,
+		// ops 1-4 are the writes below, 5 is the first sync
+		At: map[uint64]Fault{ 2: FaultFail, 3: FaultTear, 4: FaultReorder },
+	}
+	backend, err := FaultOpener(fs.Open, plan, func(opened *FaultBackend) { fb = opened })("a.moo", true, nil)
+	if err != nil { t.Fatal(err) }
+
+	src := make([]byte, c.PAGE_SIZE * 4)
+	fillRandFast(src)
+	run := func(op *DiskOp) int32 {
+		backend.Submit(op)
+		<- op.Ch
+		return op.Res
+	}
+
+	var op DiskOp
+	for i := range 4 {
+		op.PrepareOpSlice(OpWrite, src[i*c.PAGE_SIZE:], uint64(i*c.PAGE_SIZE))
+		res := run(&op)
+		if i == 1 {
+			if res != -int32(syscall.EIO) { t.Fatal("failed write", res) }
+		} else if res != c.PAGE_SIZE {
+			t.Fatal("write", i, res)
+		}
+	}
+
+	// nothing synced yet, but reads see the cache
+	if len(fs.File("a.moo").Bytes()) != 0 { t.Fatal("unsynced writes reached the file") }
+	dst := make([]byte, c.PAGE_SIZE)
+	op.PrepareOpSlice(OpRead, dst, c.PAGE_SIZE * 3)
+	if run(&op) != c.PAGE_SIZE || !slices.Equal(dst, src[c.PAGE_SIZE*3:]) { t.Fatal("read through cache") }
+
+	op.PrepareOpSlice(OpSync, nil, 0)
+	if res := run(&op); res < 0 { t.Fatal("sync", res) }
+
+	file := fs.File("a.moo").Bytes()
+	if !slices.Equal(file[:c.PAGE_SIZE], src[:c.PAGE_SIZE]) { t.Fatal("synced write missing") }
+	if !slices.Equal(file[c.PAGE_SIZE:c.PAGE_SIZE*2], make([]byte, c.PAGE_SIZE)) { t.Fatal("failed write landed") }
+	// only some leading sectors of the torn one, and none of the reordered one
+	torn := file[c.PAGE_SIZE*2:]
+	if len(torn) >= c.PAGE_SIZE || len(torn) % SECTOR_SIZE != 0 { t.Fatal("torn write", len(torn)) }
+	if !slices.Equal(torn, src[c.PAGE_SIZE*2:c.PAGE_SIZE*2 + len(torn)]) { t.Fatal("torn write garbled") }
+
+	// the reordered write is still cached, and goes with the crash
+	if fb.Ops() != 5 { t.Fatal("ops", fb.Ops()) }
+	fb.Crash()
+	op.PrepareOpSlice(OpRead, dst, 0)
+	if res := run(&op); res != -int32(syscall.EIO) { t.Fatal("read after crash", res) }
+	backend.Close()
+	if len(fs.File("a.moo").Bytes()) != len(file) { t.Fatal("crash didn't lose the cached write") }
+
+	// same seed, same random faults
+	faults := func() []int32 {
+		plan := FaultPlan{ Seed: 7, Fail: 0.2, Drop: 0.2, Tear: 0.2, Reorder: 0.2 }
+		backend := CreateFaultBackend(must(fs.Open("b.moo", true, nil)), plan)
+		defer backend.Close()
+		var ress []int32
+		for i := range 64 {
+			op.PrepareOpSlice(OpWrite, src, uint64(i*c.PAGE_SIZE))
+			backend.Submit(&op)
+			<- op.Ch
+			ress = append(ress, op.Res)
+		}
+		return ress
+	}
+	first := faults()
+	if !slices.Contains(first, -int32(syscall.EIO)) { t.Fatal("no write failed") }
+	if !slices.Equal(first, faults()) { t.Fatal("same seed gave different faults") }
+
+	// crashing in the middle of a sync persists some of what it covers, but fails it
+	backend = CreateFaultBackend(must(fs.Open("c.moo", true, nil)), FaultPlan{ Seed: 3, CrashAt: 5 })
+	defer backend.Close()
+	for i := range 4 {
+		op.PrepareOpSlice(OpWrite, src[i*c.PAGE_SIZE:], uint64(i*c.PAGE_SIZE))
+		if res := run(&op); res != c.PAGE_SIZE { t.Fatal("write", i, res) }
+	}
+	op.PrepareOpSlice(OpSync, nil, 0)
+	if res := run(&op); res != -int32(syscall.EIO) { t.Fatal("sync through a crash", res) }
+}
+
+func must[T any](v T, err error) T {
+	if err != nil { panic(err) }
+	return v
+}
+
+func Test_Backend_Close(t *testing.T) {
+	for name, open := range map[string]Opener{ "uring": OpenUring, "pool": OpenPool } {
+		t.Run(name, func(t *testing.T) {
+			const PAGES = RING_ENTRIES * 2
+			slab, err := AllocAlignedSlab(c.PAGE_SIZE * PAGES)
+			if err != nil { t.Fatal(err) }
+			defer DeallocAlignedSlab(slab)
+			fillRandFast(slab)
+
+			fp := tempfile(t)
+			backend, err := open(fp, true, slab)
+			if err != nil { t.Fatal(err) }
+
+			// more than fits in the ring at once, nobody waiting on any of them
+			ops := make([]DiskOp, PAGES)
+			for i := range ops {
+				ops[i].PrepareOpSlice(OpWrite, slab[i*c.PAGE_SIZE:], uint64(i*c.PAGE_SIZE))
+				backend.Submit(&ops[i])
+			}
+			backend.Close()
+
+			for i := range ops {
+				select {
+				case <- ops[i].Ch:
+				default:
+					t.Fatal("op still pending after Close", i)
+				}
+				if ops[i].Res != c.PAGE_SIZE { t.Fatal("write", i, ops[i].Res) }
+			}
+
+			var op DiskOp
+			op.PrepareOpSlice(OpRead, slab, 0)
+			backend.Submit(&op)
+			<- op.Ch
+			if op.Res != -int32(syscall.ECANCELED) { t.Fatal("submit after close", op.Res) }
+			backend.Close()
+
+			data, err := os.ReadFile(fp)
+			if err != nil { t.Fatal(err) }
+			if !slices.Equal(slab, data) { t.Fatal("file doesn't hold what was written") }
+		})
+	}
+}
+
+func Test_Iomgr_Ring_Failure(t *testing.T) {
+	slab, err := AllocAlignedSlab(c.PAGE_SIZE * 8)
+	if err != nil { t.Fatal(err) }
+	defer DeallocAlignedSlab(slab)
+
+	iomgr, err := CreateIoMgr(tempfile(t))
+	if err != nil { t.Fatal(err) }
+	defer iomgr.Close()
+
+	var op DiskOp
+	op.PrepareOpSlice(OpWrite, slab, 0)
+	iomgr.Submit(&op)
+	<- op.Ch
+	if op.Res != c.PAGE_SIZE || iomgr.Err() != nil { t.Fatal("write", op.Res, iomgr.Err()) }
+
+	// pull the ring out from under it - io_uring_enter on /dev/null won't get far
+	null, err := unix.Open("/dev/null", unix.O_RDWR, 0)
+	if err != nil { t.Fatal(err) }
+	defer unix.Close(null)
+	if err := unix.Dup2(null, iomgr.ring.RingFd()); err != nil { t.Fatal(err) }
+
+	ops := make([]DiskOp, 8)
+	for i := range ops {
+		ops[i].PrepareOpSlice(OpWrite, slab[i*c.PAGE_SIZE:], uint64(i*c.PAGE_SIZE))
+		iomgr.Submit(&ops[i])
+	}
+	for i := range ops {
+		<- ops[i].Ch
+		if ops[i].Res >= 0 { t.Fatal("op on a dead ring succeeded", i, ops[i].Res) }
+	}
+	if iomgr.Err() == nil { t.Fatal("ring failed but Err is nil") }
+
+	// from here on without going anywhere near the ring
+	op.PrepareOpSlice(OpSync, nil, 0)
+	iomgr.Submit(&op)
+	select {
+	case <- op.Ch:
+	default:
+		t.Fatal("op on a failed IoMgr wasn't completed straight away")
+	}
+	if op.Res != ops[0].Res { t.Fatal("different error", op.Res, ops[0].Res) }
+}
@@ -45,6 +45,7 @@ func (q *Queue[T]) Pop() T {
 type TicketQueue[T any] struct {
 	queue		Queue[int]
 	data		[]T
+	held 		[]bool // tickets that are out
 }
 
 func CreateTicketQueue[T any](size int) TicketQueue[T] {
@@ -57,6 +58,7 @@ func CreateTicketQueue[T any](size int) TicketQueue[T] {
 	return TicketQueue[T]{
 		queue: queue,
 		data: data,
+		held: make([]bool, size),
 	}
 }
 
@@ -64,13 +66,22 @@ func CreateTicketQueue[T any](size int) TicketQueue[T] {
 func (tq *TicketQueue[T]) Acq(val T) int {
 	ticket := tq.queue.Pop()
 	tq.data[ticket] = val
+	tq.held[ticket] = true
 	return ticket
 }
 
 func (tq *TicketQueue[T]) Rel(ticket int) {
+	tq.held[ticket] = false
 	tq.queue.Push(ticket)
 }
 
+// Calls fn for every ticket that is out, in ticket order. fn may Rel the ticket it's given.
+func (tq *TicketQueue[T]) Held(fn func(ticket int, val T)) {
+	for ticket, held := range tq.held {
+		if held { fn(ticket, tq.data[ticket]) }
+	}
+}
+
 func (tq *TicketQueue[T]) Get(ticket int) T {
 	return tq.data[ticket]
 }
@@ -48,3 +48,22 @@ func Test_TicketQueue(t *testing.T) {
 		tq.Rel(i)
 	}
 }
+
+func Test_TicketQueue_Held(t *testing.T) {
+	tq := util.CreateTicketQueue[string](4)
+	a := tq.Acq("a")
+	b := tq.Acq("b")
+	tq.Acq("c")
+	tq.Rel(b)
+
+	var held []string
+	tq.Held(func(ticket int, val string) {
+		held = append(held, val)
+		if ticket == a { tq.Rel(ticket) }
+	})
+	assert.Equal(t, []string{"a", "c"}, held)
+
+	held = nil
+	tq.Held(func(_ int, val string) { held = append(held, val) })
+	assert.Equal(t, []string{"c"}, held)
+}